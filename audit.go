@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"gocash/pkg/logger"
+	"gocash/pkg/store"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Actions of the audit events
+const (
+	AuditLogin                   = "auth.login"
+	AuditLoginFailed             = "auth.login_failed"
+	AuditLoginLocked             = "auth.login_locked"
+	AuditTokenRefresh            = "auth.token_refresh"
+	AuditTokenReused             = "auth.refresh_token_reused"
+	AuditLogout                  = "auth.logout"
+	AuditLogoutAll               = "auth.logout_all"
+	AuditCashCreate              = "cash.create"
+	AuditCashVoid                = "cash.void"
+	AuditRangeCreate             = "range.create"
+	AuditDenominationsSet        = "denominations.set"
+	AuditClientCreate            = "client.create"
+	AuditClientUpdate            = "client.update"
+	AuditClientDelete            = "client.delete"
+	AuditAPIKeyCreate            = "api_key.create"
+	AuditAPIKeyRevoke            = "api_key.revoke"
+	AuditSigningSecretSet        = "client.signing_secret_set"
+	AuditSigningSecretDelete     = "client.signing_secret_delete"
+	AuditClientLimitsSet         = "client.limits_set"
+	AuditUserCreate              = "user.create"
+	AuditUserDisable             = "user.disable"
+	AuditUserEnable              = "user.enable"
+	AuditUserDelete              = "user.delete"
+	AuditUserPasswordReset       = "user.password_reset"
+	AuditUserPasswordChange      = "user.password_change"
+	AuditUserRoleSet             = "user.role_set"
+	AuditUserUnlock              = "user.unlock"
+	AuditTwoFactorEnable         = "user.two_factor_enable"
+	AuditTwoFactorDisable        = "user.two_factor_disable"
+	AuditTwoFactorReset          = "user.two_factor_reset"
+	AuditRecoveryCodesRegenerate = "user.recovery_codes_regenerate"
+	AuditTwoFactorRolesSet       = "policy.two_factor_roles_set"
+)
+
+// AuditEventResponse is an audit event, before and after are JSON of the changed resource
+type AuditEventResponse struct {
+	ID           int64           `json:"id"`
+	CreatedAt    time.Time       `json:"created_at"`
+	Action       string          `json:"action"`
+	Actor        string          `json:"actor"`
+	Client       string          `json:"client"`
+	IP           string          `json:"ip"`
+	UserAgent    string          `json:"user_agent"`
+	ResourceUUID *uuid.UUID      `json:"resource_uuid"`
+	Before       json.RawMessage `json:"before"`
+	After        json.RawMessage `json:"after"`
+}
+
+// AuditEntry is what has been done by whom, the request adds ip and user agent
+type AuditEntry struct {
+	Action       string
+	Actor        string
+	Client       string
+	ResourceUUID *uuid.UUID
+	Before       interface{}
+	After        interface{}
+}
+
+// userActor is the audit actor of an authenticated user
+func userActor(username string) string {
+	return "user:" + username
+}
+
+// apiKeyActor is the audit actor of a device, the key itself is a secret
+// so it's identified by uuid
+func apiKeyActor(apiKey store.APIKey) string {
+	return "api_key:" + apiKey.UUID.String()
+}
+
+// audit appends the entry to the audit log. The operation has already been done,
+// so failures are only logged
+func (s *Server) audit(ctx *gin.Context, entry AuditEntry) {
+	event := store.AuditEvent{
+		CreatedAt:    time.Now(),
+		Action:       entry.Action,
+		Actor:        entry.Actor,
+		Client:       entry.Client,
+		IP:           ctx.ClientIP(),
+		UserAgent:    ctx.Request.UserAgent(),
+		ResourceUUID: entry.ResourceUUID,
+	}
+	var err error
+	if entry.Before != nil {
+		if event.Before, err = json.Marshal(entry.Before); err != nil {
+			logger.Errorf("audit event %s encode error %v", entry.Action, err)
+		}
+	}
+	if entry.After != nil {
+		if event.After, err = json.Marshal(entry.After); err != nil {
+			logger.Errorf("audit event %s encode error %v", entry.Action, err)
+		}
+	}
+	if err := s.store.AddAuditEvent(ctx, event); err != nil {
+		logger.Errorf("audit event %s save error %v", entry.Action, err)
+	}
+}
+
+// /audit
+// Filters: actor, action as arrays, from, to as RFC 3339 times.
+// Users assigned to clients see only events of their clients
+// Pagination: offset, limit with defaults respectively 0, 20
+func (s *Server) listAuditEvents(ctx *gin.Context) {
+	offset, limit := Paginate(ctx)
+
+	filter := store.AuditFilter{
+		Actors:  ctx.QueryArray("actor"),
+		Actions: ctx.QueryArray("action"),
+		Clients: ScopedClients(ctx),
+		Offset:  offset,
+		Limit:   limit,
+	}
+	from, to, err := Period(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Period filter invalid",
+		})
+		return
+	}
+	filter.From, filter.To = from, to
+
+	result, total, err := s.store.ListAuditEvents(ctx, filter)
+	if err != nil {
+		logger.Errorf("audit events search error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't search from audit events",
+		})
+		return
+	}
+
+	events := make([]AuditEventResponse, 0, len(result))
+	for _, e := range result {
+		events = append(events, AuditEventResponse{
+			ID:           e.ID,
+			CreatedAt:    e.CreatedAt,
+			Action:       e.Action,
+			Actor:        e.Actor,
+			Client:       e.Client,
+			IP:           e.IP,
+			UserAgent:    e.UserAgent,
+			ResourceUUID: e.ResourceUUID,
+			Before:       e.Before,
+			After:        e.After,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"total":  total,
+	})
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocash/pkg/logger"
+	"gocash/pkg/store"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type User struct {
+	Username   string     `json:"username"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	Password   string     `json:"password,omitempty"`
+	Role       string     `json:"role,omitempty"`
+	Clients    []string   `json:"clients,omitempty"`
+	TwoFactor  bool       `json:"two_factor,omitempty"`
+}
+
+type Claims struct {
+	User      User   `json:"user"`
+	TokenType string `json:"token_type"`
+	jwt.RegisteredClaims
+}
+
+// Token types, Auth accepts access tokens only, /token refresh tokens only
+// and /login/2fa challenge tokens only
+const (
+	TokenAccess    = "access"
+	TokenRefresh   = "refresh"
+	TokenChallenge = "challenge"
+)
+
+// claimsKey is the context key of the claims set by Auth
+const claimsKey = "claims"
+
+// CurrentClaims returns claims of the user authenticated by Auth
+func CurrentClaims(c *gin.Context) *Claims {
+	return c.MustGet(claimsKey).(*Claims)
+}
+
+func (s *Server) login(ctx *gin.Context) {
+	// Get body from the request
+	var user User
+	if err := ctx.BindJSON(&user); err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Couln't parse the request to user",
+		})
+		return
+	}
+
+	// Usernames and IPs with recent failures wait before the next try
+	retryAt, err := s.loginBlockedUntil(ctx, user.Username)
+	if err != nil {
+		storeError(ctx, err, "Couldn't check failed logins")
+		return
+	}
+	if retryAt.After(time.Now()) {
+		tooManyLogins(ctx, retryAt)
+		return
+	}
+
+	// Find the user with given data from database
+	dUser, err := s.store.UserByUsername(ctx, user.Username)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		storeError(ctx, err, "Couldn't find user")
+		return
+	}
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPassword, []byte(user.Password))
+		s.loginFailed(ctx, user.Username, loginUnknownUser)
+		return
+	}
+
+	// Compare passwords
+	if err := bcrypt.CompareHashAndPassword([]byte(dUser.Password), []byte(user.Password)); err != nil {
+		s.loginFailed(ctx, user.Username, loginWrongPassword)
+		return
+	}
+
+	// Disabled state is told only to the ones knowing the password
+	if dUser.DisabledAt != nil {
+		s.audit(ctx, AuditEntry{Action: AuditLoginFailed, Actor: userActor(user.Username), After: gin.H{"reason": "user_disabled"}})
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":   "user_disabled",
+			"message": "User is disabled",
+		})
+		return
+	}
+
+	// Users with two-factor authentication finish the login at /login/2fa
+	required, err := s.twoFactorRequired(ctx, dUser)
+	if err != nil {
+		storeError(ctx, err, "Couldn't check two-factor policy")
+		return
+	}
+	if dUser.TOTPEnabledAt != nil || required {
+		s.loginChallenge(ctx, dUser)
+		return
+	}
+
+	s.startSession(ctx, dUser, gin.H{})
+}
+
+// startSession issues tokens of the authenticated user and responds with them and the fields
+func (s *Server) startSession(ctx *gin.Context, user store.User, fields gin.H) {
+	// Every login starts a new family of refresh tokens
+	refresh := s.newRefreshToken()
+	refresh.Family = uuid.New()
+	refresh.Username = user.Username
+	if err := s.store.CreateRefreshToken(ctx, refresh); err != nil {
+		logger.Errorf("refresh token save error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Coulnd't create token",
+		})
+		return
+	}
+
+	// Generate new token
+	tokens, err := s.GenerateJWT(User{Username: user.Username, Role: user.Role, Clients: user.Clients}, refresh)
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Coulnd't create token",
+		})
+		return
+	}
+
+	if err := s.store.ClearLoginFailures(ctx, userAttemptKey(user.Username)); err != nil {
+		logger.Errorf("login failures clear error %v", err)
+	}
+
+	s.audit(ctx, AuditEntry{Action: AuditLogin, Actor: userActor(user.Username)})
+
+	// Send success response
+	fields["access_token"] = tokens.AccessToken
+	fields["refresh_token"] = tokens.RefreshToken
+	ctx.JSON(http.StatusOK, fields)
+}
+
+func (s *Server) token(c *gin.Context) {
+	// Get refresh token from request body
+	token := Tokens{}
+	if err := c.BindJSON(&token); err != nil {
+		logger.Errorf("couldn't bind token body %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't parse the request body",
+		})
+		return
+	}
+
+	// Validate jwt token, expired tokens don't parse
+	claims, id, err := s.parseRefreshToken(token.RefreshToken)
+	if err != nil {
+		logger.Errorf("token didn't parse %v", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't parse token",
+		})
+		return
+	}
+
+	// Disabled and deleted users can't refresh
+	user, err := s.store.UserByUsername(c, claims.User.Username)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		logger.Errorf("user search error %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't find user",
+		})
+		return
+	}
+	if err != nil || user.DisabledAt != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error":   "user_disabled",
+			"message": "User is disabled",
+		})
+		return
+	}
+
+	// Refresh tokens are single use, the used one is replaced in its family
+	refresh, err := s.store.RotateRefreshToken(c, id, s.newRefreshToken())
+	switch {
+	case errors.Is(err, store.ErrTokenReused):
+		s.audit(c, AuditEntry{Action: AuditTokenReused, Actor: userActor(user.Username)})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error":   "token_reused",
+			"message": "Token is already used, log in again",
+		})
+		return
+	case errors.Is(err, store.ErrNotFound):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error":   "token_revoked",
+			"message": "Token is revoked",
+		})
+		return
+	case err != nil:
+		logger.Errorf("refresh token rotate error %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't create refresh token",
+		})
+		return
+	}
+
+	// Role and clients could be changed since the login
+	tokens, err := s.GenerateJWT(User{Username: user.Username, Role: user.Role, Clients: user.Clients}, refresh)
+	if err != nil {
+		logger.Errorf("couldn't create refresh token")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't create refresh token",
+		})
+		return
+	}
+
+	s.audit(c, AuditEntry{Action: AuditTokenRefresh, Actor: userActor(user.Username)})
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// logout revokes the refresh token with every token rotated from the same login.
+// Access tokens stay valid until they expire
+func (s *Server) logout(c *gin.Context) {
+	token := Tokens{}
+	if err := c.BindJSON(&token); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't parse the request body",
+		})
+		return
+	}
+
+	claims, id, err := s.parseRefreshToken(token.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't parse token",
+		})
+		return
+	}
+
+	if err := s.store.RevokeRefreshTokenFamily(c, id, time.Now()); err != nil {
+		storeError(c, err, "Couldn't revoke token")
+		return
+	}
+
+	s.audit(c, AuditEntry{Action: AuditLogout, Actor: userActor(claims.User.Username)})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully logged out",
+	})
+}
+
+// logoutAll revokes every refresh token of the current user
+func (s *Server) logoutAll(c *gin.Context) {
+	username := CurrentClaims(c).User.Username
+	if err := s.store.RevokeUserRefreshTokens(c, username, time.Now()); err != nil {
+		storeError(c, err, "Couldn't revoke tokens")
+		return
+	}
+
+	s.audit(c, AuditEntry{Action: AuditLogoutAll, Actor: userActor(username)})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully logged out everywhere",
+	})
+}
+
+// Authentication middleware, role and clients of the user are read from the store on every request
+func (s *Server) Auth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := &Claims{}
+		var token string
+
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error":   "token_required",
+				"message": "Auth token is required",
+			})
+			return
+		}
+		splitToken := strings.Split(authHeader, "Bearer ")
+		if len(splitToken) > 1 {
+			token = splitToken[1]
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":   "token_wrong",
+				"message": "Invalid token",
+			})
+			return
+		}
+		tkn, err := jwt.ParseWithClaims(token, claims, s.keys.Keyfunc)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":   err.Error(),
+				"message": "Couldn't parse token",
+			})
+			return
+		}
+
+		if claims.ExpiresAt.Unix() < time.Now().Local().Unix() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":   "token_expired",
+				"message": "Token expired",
+			})
+			return
+		}
+
+		if !tkn.Valid || claims.TokenType != TokenAccess {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":   "invalid_token",
+				"message": "Invalid token",
+			})
+			return
+		}
+
+		// Disabled users and changed roles apply before the token expires
+		user, err := s.store.UserByUsername(c, claims.User.Username)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			logger.Errorf("user search error %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error":   err.Error(),
+				"message": "Couldn't find user",
+			})
+			return
+		}
+		if err != nil || user.DisabledAt != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":   "user_disabled",
+				"message": "User is disabled",
+			})
+			return
+		}
+		claims.User.Role = user.Role
+		claims.User.Clients = user.Clients
+
+		c.Set(claimsKey, claims)
+		c.Next()
+	}
+}
+
+// apiKeyContextKey is the context key of the api key set by DeviceAuth
+const apiKeyContextKey = "api_key"
+
+// clientContextKey is the context key of the api key's client set by DeviceAuth
+const clientContextKey = "client"
+
+// CurrentAPIKey returns the api key of the device authenticated by DeviceAuth
+func CurrentAPIKey(c *gin.Context) store.APIKey {
+	return c.MustGet(apiKeyContextKey).(store.APIKey)
+}
+
+// CurrentClient returns the client of the device authenticated by DeviceAuth
+func CurrentClient(c *gin.Context) store.Client {
+	return c.MustGet(clientContextKey).(store.Client)
+}
+
+// DeviceAuth authenticates devices by X-API-Key or Authorization: ApiKey header.
+// Deprecated api_key field of the JSON body is accepted when both headers are empty
+func (s *Server) DeviceAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("X-API-Key")
+		if key == "" {
+			if scheme, value, ok := strings.Cut(c.GetHeader("Authorization"), " "); ok && strings.EqualFold(scheme, "ApiKey") {
+				key = strings.TrimSpace(value)
+			}
+		}
+		if key == "" {
+			key = bodyAPIKey(c)
+			if key != "" {
+				c.Header("Deprecation", "true")
+				c.Header("Warning", `299 - "api_key body field is deprecated, use X-API-Key header"`)
+			}
+		}
+		if key == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error":   "api_key_required",
+				"message": "API key is required",
+			})
+			return
+		}
+
+		apiKey, client, err := s.useAPIKey(c, key)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, store.ErrNotFound) {
+				status = http.StatusUnauthorized
+			} else {
+				logger.Errorf("api key search error %v", err)
+			}
+			c.AbortWithStatusJSON(status, gin.H{
+				"error":   err.Error(),
+				"message": "Client hasn't been found",
+			})
+			return
+		}
+		c.Set(apiKeyContextKey, apiKey)
+		c.Set(clientContextKey, client)
+		c.Next()
+	}
+}
+
+// useAPIKey finds the active api key with its client in the cache or in the store,
+// last use of the key is updated when it's looked up in the store
+func (s *Server) useAPIKey(c *gin.Context, key string) (store.APIKey, store.Client, error) {
+	_, hash := store.HashAPIKey(key)
+	now := time.Now()
+	if entry, ok := s.apiKeys.get(hash, now); ok {
+		return entry.apiKey, entry.client, nil
+	}
+
+	apiKey, err := s.store.UseAPIKey(c, key)
+	if err != nil {
+		return store.APIKey{}, store.Client{}, err
+	}
+	client, err := s.store.GetClient(c, apiKey.Client)
+	if err != nil {
+		return store.APIKey{}, store.Client{}, err
+	}
+	s.apiKeys.put(hash, apiKey, client, now)
+	return apiKey, client, nil
+}
+
+// bodyAPIKey reads api_key field of the JSON body and restores the body for the handler
+func bodyAPIKey(c *gin.Context) string {
+	if c.Request.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var fields struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ""
+	}
+	return fields.APIKey
+}
+
+// GenerateJWT creates access token of the user and refresh token with id and expiry of refresh
+func (s *Server) GenerateJWT(user User, refresh store.RefreshToken) (token Tokens, err error) {
+	token.AccessToken, err = s.signToken(&Claims{
+		User:      user,
+		TokenType: TokenAccess,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(refresh.CreatedAt.Add(s.config.JWT.AccessTokenTimeout)),
+		},
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	token.RefreshToken, err = s.signToken(&Claims{
+		User:      User{Username: user.Username},
+		TokenType: TokenRefresh,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        refresh.ID.String(),
+			ExpiresAt: jwt.NewNumericDate(refresh.ExpiresAt),
+		},
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return token, nil
+}
+
+// newRefreshToken returns a refresh token issued now, family and user are set by the caller or the store
+func (s *Server) newRefreshToken() store.RefreshToken {
+	now := time.Now()
+	return store.RefreshToken{
+		ID:        uuid.New(),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.config.JWT.RefreshTokenTimeout),
+	}
+}
+
+func (s *Server) signToken(claims *Claims) (string, error) {
+	return s.keys.Sign(claims)
+}
+
+// parseRefreshToken validates the refresh token and returns its id
+func (s *Server) parseRefreshToken(token string) (*Claims, uuid.UUID, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, s.keys.Keyfunc)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	if claims.TokenType != TokenRefresh {
+		return nil, uuid.Nil, errors.New("token is not a refresh token")
+	}
+	id, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return nil, uuid.Nil, fmt.Errorf("token id: %w", err)
+	}
+	return claims, id, nil
+}
+
+// jwks publishes the public keys verifying the tokens
+func (s *Server) jwks(c *gin.Context) {
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.config.JWT.KeysReload.Seconds())))
+	c.JSON(http.StatusOK, gin.H{
+		"keys": s.keys.JWKS(),
+	})
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gocash/pkg/arrs"
+	"gocash/pkg/config"
+	"gocash/pkg/logger"
+	"gocash/pkg/money"
+	"gocash/pkg/store"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CashFields are fields of a cash sent by a device.
+// Currency is ISO 4217 code, default_currency is used when it's empty.
+// InsertedAt is the time the device has accepted the cash, it's checked
+// against device.clock_skew_window and device.time_max_age.
+// Repeated cashes with the same idempotency key return the original cash
+type CashFields struct {
+	Amount         money.Amount `json:"amount" binding:"required"`
+	Currency       string       `json:"currency"`
+	Contact        string       `json:"contact" binding:"required"`
+	Detail         string       `json:"detail"`
+	Note           string       `json:"note"`
+	InsertedAt     *time.Time   `json:"inserted_at"`
+	IdempotencyKey string       `json:"idempotency_key"`
+}
+
+// CashBody is a cash sent by a device,
+// Idempotency-Key header takes precedence over idempotency_key field
+type CashBody struct {
+	// Deprecated: APIKey is read by DeviceAuth only when X-API-Key header is empty
+	APIKey string `json:"api_key"`
+	CashFields
+}
+
+type CashBodyResponse struct {
+	UUID        uuid.UUID     `json:"uuid"`
+	Amount      money.Amount  `json:"amount" binding:"required"`
+	Currency    string        `json:"currency"`
+	Detail      string        `json:"detail"`
+	Note        string        `json:"note"`
+	Client      string        `json:"client"`
+	Contact     string        `json:"contact"`
+	CreatedAt   time.Time     `json:"created_at"`
+	InsertedAt  *time.Time    `json:"inserted_at"`
+	ClockSkewed bool          `json:"clock_skewed"`
+	RangeUUID   *uuid.UUID    `json:"range_uuid"`
+	Voided      bool          `json:"voided"`
+	Void        *VoidResponse `json:"void"`
+}
+
+// VoidBody is the reason of voiding a cash
+type VoidBody struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// VoidResponse is who, when and why has voided a cash
+type VoidResponse struct {
+	Reason   string    `json:"reason"`
+	VoidedBy string    `json:"voided_by"`
+	VoidedAt time.Time `json:"voided_at"`
+}
+
+func newCashBodyResponse(cash store.Cash) CashBodyResponse {
+	var void *VoidResponse
+	if cash.Void != nil {
+		void = &VoidResponse{
+			Reason:   cash.Void.Reason,
+			VoidedBy: cash.Void.By,
+			VoidedAt: cash.Void.At,
+		}
+	}
+	return CashBodyResponse{
+		UUID:        cash.UUID,
+		Amount:      cash.Amount,
+		Currency:    cash.Currency,
+		Detail:      cash.Detail,
+		Note:        cash.Note,
+		Client:      cash.Client,
+		Contact:     cash.Contact,
+		CreatedAt:   cash.CreatedAt,
+		InsertedAt:  cash.InsertedAt,
+		ClockSkewed: cash.ClockSkewed,
+		RangeUUID:   cash.RangeUUID,
+		Voided:      void != nil,
+		Void:        void,
+	}
+}
+
+// newCash validates the fields and creates a new cash of the client
+func (s *Server) newCash(client string, fields CashFields) (store.Cash, error) {
+	if fields.Amount <= 0 {
+		return store.Cash{}, errors.New("amount must be positive")
+	}
+	currency := s.config.DefaultCurrency
+	if fields.Currency != "" {
+		var err error
+		currency, err = money.ParseCurrency(fields.Currency)
+		if err != nil {
+			return store.Cash{}, err
+		}
+	}
+	if err := fields.Amount.CheckCurrency(currency); err != nil {
+		return store.Cash{}, err
+	}
+
+	now := time.Now()
+	skewed := false
+	if fields.InsertedAt != nil {
+		device := s.config.Device
+		skewed = fields.InsertedAt.After(now.Add(device.ClockSkewWindow)) || fields.InsertedAt.Before(now.Add(-device.TimeMaxAge))
+		if skewed && device.ClockSkewPolicy == config.ClockSkewReject {
+			return store.Cash{}, fmt.Errorf("inserted_at %s is outside of the allowed clock skew window", fields.InsertedAt.Format(time.RFC3339))
+		}
+	}
+
+	return store.Cash{
+		UUID:        uuid.New(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		InsertedAt:  fields.InsertedAt,
+		ClockSkewed: skewed,
+		Client:      client,
+		Contact:     fields.Contact,
+		Amount:      fields.Amount,
+		Currency:    currency,
+		Detail:      fields.Detail,
+		Note:        fields.Note,
+	}, nil
+}
+
+func (s *Server) createCash(ctx *gin.Context) {
+	// Get request body
+	var body CashBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(400, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	idempotency, err := s.Idempotency(ctx, body.IdempotencyKey)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":   err.Error(),
+			"message": "Idempotency key invalid",
+		})
+		return
+	}
+
+	// Find the client with the given key
+	apiKey := CurrentAPIKey(ctx)
+	client := apiKey.Client
+
+	cash, err := s.newCash(client, body.CashFields)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	// Insert request to database
+	cash, duplicate, err := s.store.CreateCash(ctx, cash, idempotency)
+	if err != nil {
+		logger.Errorf("database save error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't save into cashes",
+		})
+		return
+	}
+	if duplicate {
+		ctx.Header("Idempotent-Replayed", "true")
+	} else {
+		s.audit(ctx, AuditEntry{
+			Action:       AuditCashCreate,
+			Actor:        apiKeyActor(apiKey),
+			Client:       client,
+			ResourceUUID: &cash.UUID,
+			After:        newCashBodyResponse(cash),
+		})
+	}
+
+	// Send success result
+	ctx.JSON(201, gin.H{
+		"message": "Successfully saved into database",
+		"uuid":    cash.UUID.String(),
+	})
+}
+
+// /cashes
+// Filters: amount as exact decimal, currency as ISO 4217 code, uuid, range_uuid, detail, note, client, contact as array
+// Period: from, to as RFC 3339 times by clock server (default) or device
+// Voided cashes are listed only with include_voided=true, users assigned to clients see only their cashes
+// Pagination: offset, limit with defaults respectively 0, 20
+func (s *Server) listCashes(ctx *gin.Context) {
+	offset, limit := Paginate(ctx)
+
+	filter := store.CashFilter{
+		Patterns: map[string]string{},
+		Clock:    store.Clock(ctx.DefaultQuery("clock", string(store.ClockServer))),
+		Offset:   offset,
+		Limit:    limit,
+	}
+	filter.IncludeVoided, _ = strconv.ParseBool(ctx.Query("include_voided"))
+	filter.Clients = ScopedClients(ctx)
+	if filter.Clock != store.ClockServer && filter.Clock != store.ClockDevice {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   fmt.Sprintf("unknown clock %q, available clocks: server, device", filter.Clock),
+			"message": "Clock filter invalid",
+		})
+		return
+	}
+	from, to, err := Period(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Period filter invalid",
+		})
+		return
+	}
+	filter.From, filter.To = from, to
+	for k, v := range ctx.Request.URL.Query() {
+		if k == "amount" {
+			for _, vamount := range v {
+				amount, err := money.Parse(vamount)
+				if err != nil {
+					ctx.JSON(http.StatusBadRequest, gin.H{
+						"error":   err.Error(),
+						"message": "Amount filter invalid",
+					})
+					return
+				}
+				filter.Amounts = append(filter.Amounts, amount)
+			}
+			continue
+		}
+		if k == "currency" {
+			for _, vcurrency := range v {
+				currency, err := money.ParseCurrency(vcurrency)
+				if err != nil {
+					ctx.JSON(http.StatusBadRequest, gin.H{
+						"error":   err.Error(),
+						"message": "Currency filter invalid",
+					})
+					return
+				}
+				filter.Currencies = append(filter.Currencies, currency)
+			}
+			continue
+		}
+		if !arrs.Contains(store.CashFilterFields, k) {
+			continue
+		}
+		if k == "contact" {
+			for kcon, vcon := range v {
+				if strings.Contains(vcon, " ") {
+					str, _ := url.QueryUnescape(strings.Split(vcon, " ")[1])
+					v[kcon] = str
+				}
+			}
+		}
+		filter.Patterns[k] = strings.Join(v, "|")
+	}
+
+	result, total, err := s.store.ListCashes(ctx, filter)
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't search from cashes",
+		})
+		return
+	}
+
+	cashes := make([]CashBodyResponse, 0, len(result))
+	for _, cash := range result {
+		cashes = append(cashes, newCashBodyResponse(cash))
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"cashes": cashes,
+		"total":  total,
+	})
+}
+
+func (s *Server) getCash(ctx *gin.Context) {
+	// Get UUID from URL param
+	cashUUID, err := uuid.Parse(ctx.Param("uuid"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Coulnd't find UUID",
+		})
+		return
+	}
+
+	// Find the cash with given UUID, cashes of other clients aren't visible to scoped users
+	cash, err := s.store.GetCash(ctx, cashUUID)
+	if err == nil && !inScope(ctx, cash.Client) {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		logger.Error(err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		ctx.JSON(status, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't find the cash details",
+		})
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"cash": newCashBodyResponse(cash),
+	})
+}
+
+// voidCash keeps the open cash but excludes it from range totals and reports
+func (s *Server) voidCash(ctx *gin.Context) {
+	// Get UUID from URL param
+	cashUUID, err := uuid.Parse(ctx.Param("uuid"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Coulnd't find UUID",
+		})
+		return
+	}
+
+	// Get request body
+	var body VoidBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+	if strings.TrimSpace(body.Reason) == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "reason is required",
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	// Users restricted to clients can void only cashes of those clients
+	before, err := s.store.GetCash(ctx, cashUUID)
+	if err == nil && !inScope(ctx, before.Client) {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the cash details")
+		return
+	}
+
+	cash, err := s.store.VoidCash(ctx, cashUUID, store.Void{
+		At:     time.Now(),
+		By:     CurrentClaims(ctx).User.Username,
+		Reason: body.Reason,
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, store.ErrAlreadyVoided), errors.Is(err, store.ErrSettled):
+			status = http.StatusConflict
+		default:
+			logger.Errorf("cash void error %v", err)
+		}
+		ctx.JSON(status, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't void the cash",
+		})
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action:       AuditCashVoid,
+		Actor:        userActor(CurrentClaims(ctx).User.Username),
+		Client:       cash.Client,
+		ResourceUUID: &cash.UUID,
+		Before:       newCashBodyResponse(before),
+		After:        newCashBodyResponse(cash),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Successfully voided",
+		"cash":    newCashBodyResponse(cash),
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"gocash/pkg/logger"
+	"gocash/pkg/store"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+)
+
+// maxCashBatchSize is the maximum count of cashes in one batch
+const maxCashBatchSize = 1000
+
+// CashBatchBody is cashes buffered by a device while it has been offline
+type CashBatchBody struct {
+	// Deprecated: APIKey is read by DeviceAuth only when X-API-Key header is empty
+	APIKey string       `json:"api_key"`
+	Cashes []CashFields `json:"cashes" binding:"required"`
+}
+
+// Statuses of the batch items
+const (
+	CashBatchCreated   = "created"
+	CashBatchDuplicate = "duplicate"
+	CashBatchRejected  = "rejected"
+)
+
+type CashBatchResult struct {
+	Index  int        `json:"index"`
+	Status string     `json:"status"`
+	UUID   *uuid.UUID `json:"uuid,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+func (s *Server) createCashBatch(ctx *gin.Context) {
+	// Get request body
+	var body CashBatchBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+	if len(body.Cashes) > maxCashBatchSize {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   fmt.Sprintf("batch has more than %d cashes", maxCashBatchSize),
+			"message": "Batch is too large",
+		})
+		return
+	}
+
+	// Find the client with the given key
+	apiKey := CurrentAPIKey(ctx)
+	client := apiKey.Client
+
+	// Reject invalid items, the valid ones are saved together
+	results := make([]CashBatchResult, len(body.Cashes))
+	var submissions []store.CashSubmission
+	var submissionIndexes []int
+	for i, item := range body.Cashes {
+		results[i] = CashBatchResult{Index: i, Status: CashBatchRejected}
+
+		if err := binding.Validator.ValidateStruct(item); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if len(item.IdempotencyKey) > maxIdempotencyKeyLength {
+			results[i].Error = fmt.Sprintf("idempotency key is longer than %d characters", maxIdempotencyKeyLength)
+			continue
+		}
+		cash, err := s.newCash(client, item)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		submissions = append(submissions, store.CashSubmission{
+			Cash: cash,
+			Idempotency: store.Idempotency{
+				Key:   item.IdempotencyKey,
+				Since: time.Now().Add(-s.config.IdempotencyKeyTTL),
+			},
+		})
+		submissionIndexes = append(submissionIndexes, i)
+	}
+
+	// Insert valid cashes to database
+	saved, err := s.store.CreateCashes(ctx, submissions)
+	if err != nil {
+		logger.Errorf("database save error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't save into cashes",
+		})
+		return
+	}
+
+	counts := map[string]int{}
+	for i, result := range saved {
+		index := submissionIndexes[i]
+		cashUUID := result.Cash.UUID
+		results[index].UUID = &cashUUID
+		results[index].Status = CashBatchCreated
+		if result.Duplicate {
+			results[index].Status = CashBatchDuplicate
+			continue
+		}
+		s.audit(ctx, AuditEntry{
+			Action:       AuditCashCreate,
+			Actor:        apiKeyActor(apiKey),
+			Client:       client,
+			ResourceUUID: &cashUUID,
+			After:        newCashBodyResponse(result.Cash),
+		})
+	}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"results":    results,
+		"created":    counts[CashBatchCreated],
+		"duplicates": counts[CashBatchDuplicate],
+		"rejected":   counts[CashBatchRejected],
+	})
+}
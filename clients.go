@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"gocash/pkg/logger"
+	"gocash/pkg/store"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// secretSize is count of random bytes in generated api keys and signing secrets
+const secretSize = 32
+
+// ClientBody creates a client, name can't be changed later
+type ClientBody struct {
+	Name   string `json:"name" binding:"required,max=255"`
+	Detail string `json:"detail" binding:"max=255"`
+}
+
+// ClientUpdateBody changes detail of a client
+type ClientUpdateBody struct {
+	Detail string `json:"detail" binding:"max=255"`
+}
+
+// ClientResponse is a client without its signing secret
+type ClientResponse struct {
+	Name              string `json:"name"`
+	Detail            string `json:"detail"`
+	SigningEnabled    bool   `json:"signing_enabled"`
+	SignatureRequired bool   `json:"signature_required"`
+	// Limits are null when the service defaults are used
+	RateLimit  *float64  `json:"rate_limit"`
+	RateBurst  *int      `json:"rate_burst"`
+	DailyQuota *int64    `json:"daily_quota"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func newClientResponse(client store.Client) ClientResponse {
+	return ClientResponse{
+		Name:              client.Name,
+		Detail:            client.Detail,
+		SigningEnabled:    client.SigningSecret != "",
+		SignatureRequired: client.SignatureRequired,
+		RateLimit:         client.Limits.RateLimit,
+		RateBurst:         client.Limits.RateBurst,
+		DailyQuota:        client.Limits.DailyQuota,
+		CreatedAt:         client.CreatedAt,
+		UpdatedAt:         client.UpdatedAt,
+	}
+}
+
+// SigningSecretBody creates a signing secret, required rejects unsigned requests of the client
+type SigningSecretBody struct {
+	Required bool `json:"required"`
+}
+
+// APIKeyBody creates an api key, label tells keys of the client apart
+type APIKeyBody struct {
+	Label string `json:"label" binding:"max=255"`
+}
+
+// APIKeyResponse is an api key without the secret, which is shown only once
+type APIKeyResponse struct {
+	UUID       uuid.UUID  `json:"uuid"`
+	Client     string     `json:"client"`
+	Prefix     string     `json:"prefix"`
+	Label      string     `json:"label"`
+	Active     bool       `json:"active"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newAPIKeyResponse(key store.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		UUID:       key.UUID,
+		Client:     key.Client,
+		Prefix:     key.Prefix,
+		Label:      key.Label,
+		Active:     key.RevokedAt == nil,
+		CreatedAt:  key.CreatedAt,
+		RevokedAt:  key.RevokedAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+// generateSecret returns a random hex encoded api key or signing secret
+func generateSecret() (string, error) {
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Server) createClient(ctx *gin.Context) {
+	// Get request body
+	var body ClientBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	client := store.Client{
+		Name:      body.Name,
+		Detail:    body.Detail,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.store.CreateClient(ctx, client); err != nil {
+		storeError(ctx, err, "Couldn't save the client")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditClientCreate,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Client: client.Name,
+		After:  newClientResponse(client),
+	})
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"client": newClientResponse(client),
+	})
+}
+
+// /clients
+// Pagination: offset, limit with defaults respectively 0, 20
+func (s *Server) listClients(ctx *gin.Context) {
+	offset, limit := Paginate(ctx)
+
+	result, total, err := s.store.ListClients(ctx, offset, limit)
+	if err != nil {
+		storeError(ctx, err, "Couldn't search from clients")
+		return
+	}
+
+	clients := make([]ClientResponse, 0, len(result))
+	for _, client := range result {
+		clients = append(clients, newClientResponse(client))
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"clients": clients,
+		"total":   total,
+	})
+}
+
+func (s *Server) getClient(ctx *gin.Context) {
+	client, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"client": newClientResponse(client),
+	})
+}
+
+func (s *Server) updateClient(ctx *gin.Context) {
+	// Get request body
+	var body ClientUpdateBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	before, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	client := before
+	client.Detail = body.Detail
+	client.UpdatedAt = time.Now()
+	if err := s.store.UpdateClient(ctx, client); err != nil {
+		storeError(ctx, err, "Couldn't save the client")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditClientUpdate,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Client: client.Name,
+		Before: newClientResponse(before),
+		After:  newClientResponse(client),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"client": newClientResponse(client),
+	})
+}
+
+// deleteClient revokes all api keys of the client, its cashes and ranges are kept
+func (s *Server) deleteClient(ctx *gin.Context) {
+	before, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	if err := s.store.DeleteClient(ctx, before.Name, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't delete the client")
+		return
+	}
+	s.apiKeys.purge()
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditClientDelete,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Client: before.Name,
+		Before: newClientResponse(before),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Successfully deleted",
+	})
+}
+
+// createAPIKey generates a new key of the client, the key is returned only in this response
+func (s *Server) createAPIKey(ctx *gin.Context) {
+	// Get request body
+	var body APIKeyBody
+	if err := ctx.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	client, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		storeError(ctx, err, "Couldn't generate api key")
+		return
+	}
+	prefix, hash := store.HashAPIKey(secret)
+	key := store.APIKey{
+		UUID:      uuid.New(),
+		Client:    client.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Label:     body.Label,
+		CreatedAt: time.Now(),
+	}
+	if err := s.store.CreateAPIKey(ctx, key); err != nil {
+		storeError(ctx, err, "Couldn't save the api key")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action:       AuditAPIKeyCreate,
+		Actor:        userActor(CurrentClaims(ctx).User.Username),
+		Client:       client.Name,
+		ResourceUUID: &key.UUID,
+		After:        newAPIKeyResponse(key),
+	})
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"message": "Save the api key, it isn't shown again",
+		"api_key": secret,
+		"key":     newAPIKeyResponse(key),
+	})
+}
+
+func (s *Server) listAPIKeys(ctx *gin.Context) {
+	client, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	result, err := s.store.ListAPIKeys(ctx, client.Name)
+	if err != nil {
+		storeError(ctx, err, "Couldn't search from api keys")
+		return
+	}
+
+	keys := make([]APIKeyResponse, 0, len(result))
+	for _, key := range result {
+		keys = append(keys, newAPIKeyResponse(key))
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"keys": keys,
+	})
+}
+
+// revokeAPIKey rejects the key from now on, other keys of the client keep working
+func (s *Server) revokeAPIKey(ctx *gin.Context) {
+	keyUUID, err := uuid.Parse(ctx.Param("uuid"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Coulnd't find UUID",
+		})
+		return
+	}
+
+	key, err := s.store.RevokeAPIKey(ctx, ctx.Param("name"), keyUUID, time.Now())
+	if err != nil {
+		storeError(ctx, err, "Couldn't revoke the api key")
+		return
+	}
+	s.apiKeys.purge()
+
+	s.audit(ctx, AuditEntry{
+		Action:       AuditAPIKeyRevoke,
+		Actor:        userActor(CurrentClaims(ctx).User.Username),
+		Client:       key.Client,
+		ResourceUUID: &key.UUID,
+		After:        newAPIKeyResponse(key),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"key": newAPIKeyResponse(key),
+	})
+}
+
+// createSigningSecret replaces HMAC secret of the client, the secret is returned only in this response
+func (s *Server) createSigningSecret(ctx *gin.Context) {
+	// Get request body
+	var body SigningSecretBody
+	if err := ctx.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	before, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		storeError(ctx, err, "Couldn't generate signing secret")
+		return
+	}
+	client := before
+	client.SigningSecret = secret
+	client.SignatureRequired = body.Required
+	client.UpdatedAt = time.Now()
+	if err := s.store.SetSigningSecret(ctx, client.Name, secret, body.Required, client.UpdatedAt); err != nil {
+		storeError(ctx, err, "Couldn't save the signing secret")
+		return
+	}
+	s.apiKeys.purge()
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditSigningSecretSet,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Client: client.Name,
+		Before: newClientResponse(before),
+		After:  newClientResponse(client),
+	})
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"message":        "Save the signing secret, it isn't shown again",
+		"signing_secret": secret,
+		"client":         newClientResponse(client),
+	})
+}
+
+// deleteSigningSecret turns signing of the client off, unsigned requests are accepted again
+func (s *Server) deleteSigningSecret(ctx *gin.Context) {
+	before, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	client := before
+	client.SigningSecret = ""
+	client.SignatureRequired = false
+	client.UpdatedAt = time.Now()
+	if err := s.store.SetSigningSecret(ctx, client.Name, "", false, client.UpdatedAt); err != nil {
+		storeError(ctx, err, "Couldn't delete the signing secret")
+		return
+	}
+	s.apiKeys.purge()
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditSigningSecretDelete,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Client: client.Name,
+		Before: newClientResponse(before),
+		After:  newClientResponse(client),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"client": newClientResponse(client),
+	})
+}
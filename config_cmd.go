@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"gocash/pkg/config"
+	"gocash/pkg/keyset"
+	"log"
+	"os"
+)
+
+// runConfig handles `gocash config check [file]`, the file is GOCASH_CONFIG or gocash.yaml by default.
+// The values are printed after the environment is applied, so a deploy can be checked before the restart
+func runConfig(args []string) {
+	if len(args) < 1 || len(args) > 2 || args[0] != "check" {
+		log.Fatal("usage: gocash config check [file]")
+	}
+	file := os.Getenv("GOCASH_CONFIG")
+	if len(args) == 2 {
+		file = args[1]
+	}
+
+	cfg, err := config.Load(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.JWT.KeysDir != "" {
+		if _, err := keyset.Load(cfg.JWT.KeysDir, cfg.JWT.KeyPublishDelay); err != nil {
+			log.Fatalf("couldn't load jwt keys: %v", err)
+		}
+	}
+
+	for _, value := range cfg.Values() {
+		fmt.Println(value)
+	}
+	fmt.Println("config is valid")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"gocash/pkg/arrs"
+	"gocash/pkg/logger"
+	"gocash/pkg/money"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DenominationsBody is note values of the client's currency,
+// empty client means defaults of the currency for every client
+type DenominationsBody struct {
+	Client   string         `json:"client"`
+	Currency string         `json:"currency" binding:"required"`
+	Values   []money.Amount `json:"values"`
+}
+
+// inDenominationsScope checks if the user can see denominations of the client,
+// defaults of the currency (empty client) are visible only to unrestricted users
+func inDenominationsScope(ctx *gin.Context, client string) bool {
+	if client == "" {
+		return ScopedClients(ctx) == nil
+	}
+	return inScope(ctx, client)
+}
+
+// /denominations
+// Query: client (optional), currency
+func (s *Server) getDenominations(ctx *gin.Context) {
+	currency, err := money.ParseCurrency(ctx.Query("currency"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Currency invalid",
+		})
+		return
+	}
+
+	client := ctx.Query("client")
+	if !inDenominationsScope(ctx, client) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":   "client_not_assigned",
+			"message": "Client isn't assigned to you",
+		})
+		return
+	}
+	values, err := s.store.Denominations(ctx, client, currency)
+	if err != nil {
+		logger.Errorf("denominations search error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't find denominations",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, DenominationsBody{
+		Client:   client,
+		Currency: currency,
+		Values:   values,
+	})
+}
+
+// setDenominations replaces denominations, empty values removes client's own
+// denominations so the defaults of the currency are used again
+func (s *Server) setDenominations(ctx *gin.Context) {
+	var body DenominationsBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+	currency, err := money.ParseCurrency(body.Currency)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Currency invalid",
+		})
+		return
+	}
+
+	values := make([]money.Amount, 0, len(body.Values))
+	for _, v := range body.Values {
+		if v <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "value_not_positive",
+				"message": "Denomination values must be positive",
+			})
+			return
+		}
+		if err := v.CheckCurrency(currency); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"message": "Denomination value invalid",
+			})
+			return
+		}
+		if !arrs.Contains(values, v) {
+			values = append(values, v)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+
+	if !inDenominationsScope(ctx, body.Client) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":   "client_not_assigned",
+			"message": "Client isn't assigned to you",
+		})
+		return
+	}
+
+	// Keep effective denominations for the audit log
+	before, err := s.store.Denominations(ctx, body.Client, currency)
+	if err != nil {
+		logger.Errorf("denominations search error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't find denominations",
+		})
+		return
+	}
+
+	if err := s.store.SetDenominations(ctx, body.Client, currency, values); err != nil {
+		logger.Errorf("denominations save error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't save denominations",
+		})
+		return
+	}
+
+	after := DenominationsBody{
+		Client:   body.Client,
+		Currency: currency,
+		Values:   values,
+	}
+	s.audit(ctx, AuditEntry{
+		Action: AuditDenominationsSet,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Client: body.Client,
+		Before: DenominationsBody{Client: body.Client, Currency: currency, Values: before},
+		After:  after,
+	})
+
+	ctx.JSON(http.StatusOK, after)
+}
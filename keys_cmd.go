@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"gocash/pkg/config"
+	"gocash/pkg/keyset"
+	"log"
+)
+
+// runKeys handles `gocash keys generate [RS256|EdDSA]`. The key is written into jwt.keys_dir,
+// running servers publish it on reload and sign with it after jwt.key_publish_delay.
+// Old keys are removed from the directory once tokens signed with them are expired
+func runKeys(cfg config.Config, args []string) {
+	if len(args) < 1 || len(args) > 2 || args[0] != "generate" {
+		log.Fatal("usage: gocash keys generate [RS256|EdDSA]")
+	}
+	if cfg.JWT.KeysDir == "" {
+		log.Fatal("jwt.keys_dir isn't set")
+	}
+
+	algorithm := keyset.EdDSA
+	if len(args) == 2 {
+		algorithm = args[1]
+	}
+	kid, err := keyset.Generate(cfg.JWT.KeysDir, algorithm)
+	if err != nil {
+		log.Fatalf("couldn't generate key: %v", err)
+	}
+	fmt.Printf("generated key %s\n", kid)
+}
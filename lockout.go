@@ -0,0 +1,146 @@
+package main
+
+import (
+	"gocash/pkg/config"
+	"gocash/pkg/store"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loginFreeFailures is count of failed logins of a username allowed without backoff,
+// an IP is allowed login.max_failures, so one user's mistakes don't slow down others behind the same IP
+const loginFreeFailures = 3
+
+// dummyPassword is compared when the user doesn't exist, so unknown and
+// existing usernames take the same time to fail
+var dummyPassword, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Reasons of the failed logins
+const (
+	loginUnknownUser   = "unknown_user"
+	loginWrongPassword = "wrong_password"
+	loginWrongCode     = "wrong_code"
+)
+
+// Keys of the login attempt counters
+func userAttemptKey(username string) string { return "user:" + username }
+func ipAttemptKey(ip string) string         { return "ip:" + ip }
+
+// loginRetryAt returns when the next login is allowed after the failures. Delay doubles after
+// every failure beyond the free ones up to the lockout, maxFailures lock for the lockout
+func loginRetryAt(cfg config.Login, attempt store.LoginAttempt, freeFailures, maxFailures int) time.Time {
+	if attempt.Failures >= maxFailures {
+		return attempt.LastFailureAt.Add(cfg.Lockout)
+	}
+	if attempt.Failures < freeFailures {
+		return time.Time{}
+	}
+	delay := cfg.Backoff
+	for i := freeFailures; i < attempt.Failures && delay < cfg.Lockout; i++ {
+		delay *= 2
+	}
+	if delay > cfg.Lockout {
+		delay = cfg.Lockout
+	}
+	return attempt.LastFailureAt.Add(delay)
+}
+
+// loginBlockedUntil returns the latest retry time of the username and the IP counters
+func (s *Server) loginBlockedUntil(ctx *gin.Context, username string) (time.Time, error) {
+	since := time.Now().Add(-s.config.Login.Lockout)
+	userAttempt, err := s.store.LoginAttempt(ctx, userAttemptKey(username), since)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ipAttempt, err := s.store.LoginAttempt(ctx, ipAttemptKey(ctx.ClientIP()), since)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	cfg := s.config.Login
+	retryAt := loginRetryAt(cfg, userAttempt, loginFreeFailures, cfg.MaxFailures)
+	if ipRetryAt := loginRetryAt(cfg, ipAttempt, cfg.MaxFailures, cfg.MaxIPFailures); ipRetryAt.After(retryAt) {
+		retryAt = ipRetryAt
+	}
+	return retryAt, nil
+}
+
+// loginFailed counts the failure for the username and the IP, records it and responds
+// with the same error whatever the reason is
+func (s *Server) loginFailed(ctx *gin.Context, username, reason string) {
+	now := time.Now()
+	since := now.Add(-s.config.Login.Lockout)
+	userAttempt, err := s.store.AddLoginFailure(ctx, userAttemptKey(username), now, since)
+	if err != nil {
+		storeError(ctx, err, "Couldn't count the failed login")
+		return
+	}
+	if _, err := s.store.AddLoginFailure(ctx, ipAttemptKey(ctx.ClientIP()), now, since); err != nil {
+		storeError(ctx, err, "Couldn't count the failed login")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditLoginFailed,
+		Actor:  userActor(username),
+		After:  gin.H{"reason": reason, "failures": userAttempt.Failures},
+	})
+	if cfg := s.config.Login; userAttempt.Failures == cfg.MaxFailures {
+		s.audit(ctx, AuditEntry{
+			Action: AuditLoginLocked,
+			Actor:  userActor(username),
+			After:  gin.H{"until": loginRetryAt(cfg, userAttempt, loginFreeFailures, cfg.MaxFailures)},
+		})
+	}
+
+	// The password is known at the second step, so only the code is told wrong
+	if reason == loginWrongCode {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "wrong_code",
+			"message": "Invalid code",
+		})
+		return
+	}
+	ctx.JSON(http.StatusUnauthorized, gin.H{
+		"error":   "invalid_credentials",
+		"message": "Invalid username or password",
+	})
+}
+
+// tooManyLogins responds with Retry-After header of the blocked login
+func tooManyLogins(ctx *gin.Context, retryAt time.Time) {
+	seconds := int(math.Ceil(time.Until(retryAt).Seconds()))
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+	ctx.JSON(http.StatusTooManyRequests, gin.H{
+		"error":   "too_many_attempts",
+		"message": "Too many failed logins, try again later",
+	})
+}
+
+// unlockUser forgets failed logins of the user, so a locked user can log in right away
+func (s *Server) unlockUser(ctx *gin.Context) {
+	username := ctx.Param("username")
+	if _, err := s.store.UserByUsername(ctx, username); err != nil {
+		storeError(ctx, err, "Couldn't find the user")
+		return
+	}
+	if err := s.store.ClearLoginFailures(ctx, userAttemptKey(username)); err != nil {
+		storeError(ctx, err, "Couldn't unlock the user")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditUserUnlock,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		After:  gin.H{"username": username},
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "User has been unlocked",
+	})
+}
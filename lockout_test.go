@@ -0,0 +1,43 @@
+package main
+
+import (
+	"gocash/pkg/config"
+	"gocash/pkg/store"
+	"testing"
+	"time"
+)
+
+func TestLoginRetryAt(t *testing.T) {
+	cfg := config.Login{Backoff: time.Second, Lockout: 10 * time.Second}
+	last := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{0, -1},
+		{2, -1},
+		// The backoff doubles from the free failures on
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		// and stops at the lockout
+		{7, 10 * time.Second},
+		{9, 10 * time.Second},
+		{10, 10 * time.Second},
+		{1000, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		got := loginRetryAt(cfg, store.LoginAttempt{Failures: tt.failures, LastFailureAt: last}, 3, 10)
+		if tt.wait < 0 {
+			if !got.IsZero() {
+				t.Errorf("%d failures retry at %s, want no wait", tt.failures, got)
+			}
+			continue
+		}
+		if want := last.Add(tt.wait); !got.Equal(want) {
+			t.Errorf("%d failures wait %s, want %s", tt.failures, got.Sub(last), tt.wait)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gocash/pkg/config"
+	"gocash/pkg/db"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// runMigrate handles `gocash migrate up|down|status`
+func runMigrate(cfg config.Config, args []string) {
+	if len(args) != 1 {
+		log.Fatal("usage: gocash migrate up|down|status")
+	}
+
+	pool := db.CreateDB(cfg.DatabaseURL)
+	defer pool.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(context.Background(), pool)
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("couldn't migrate up: %v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	case "down":
+		reverted, err := db.MigrateDown(context.Background(), pool)
+		if err != nil {
+			log.Fatalf("couldn't migrate down: %v", err)
+		}
+		if reverted == nil {
+			fmt.Println("no applied migrations")
+			return
+		}
+		fmt.Printf("reverted %d_%s\n", reverted.Version, reverted.Name)
+	case "status":
+		statuses, err := db.Status(context.Background(), pool)
+		if err != nil {
+			log.Fatalf("couldn't get migration status: %v", err)
+		}
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+	default:
+		log.Fatalf("unknown migrate command %q, usage: gocash migrate up|down|status", args[0])
+	}
+}
+
+// checkSchema returns error if the database has pending migrations
+func checkSchema(pool *pgxpool.Pool) error {
+	pending, err := db.PendingMigrations(context.Background(), pool)
+	if err != nil {
+		return fmt.Errorf("couldn't check schema migrations: %w", err)
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is behind by %d migration(s), run `gocash migrate up` first", len(pending))
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"gocash/pkg/money"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is read when no config file is given and it exists
+const DefaultFile = "gocash.yaml"
+
+// MemoryURL is the database_url value which selects in-memory store
+const MemoryURL = "memory://"
+
+// Policies for device times outside of the clock skew window
+const (
+	ClockSkewFlag   = "flag"
+	ClockSkewReject = "reject"
+)
+
+// Config is the configuration of the service, read from a YAML file and
+// overridden by the environment variables of envVars
+type Config struct {
+	Port        string `yaml:"port"`
+	HTTP        HTTP   `yaml:"http"`
+	DatabaseURL string `yaml:"database_url"`
+	Log         Log    `yaml:"log"`
+	JWT         JWT    `yaml:"jwt"`
+	Login       Login  `yaml:"login"`
+	Device      Device `yaml:"device"`
+	// DefaultCurrency is ISO 4217 currency of cashes posted without currency
+	DefaultCurrency string `yaml:"default_currency"`
+	// IdempotencyKeyTTL is how long repeated submissions with the same key return the original response
+	IdempotencyKeyTTL time.Duration `yaml:"idempotency_key_ttl"`
+}
+
+// HTTP limits the connections and the requests of the server
+type HTTP struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests are waited for on SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	MaxHeaderBytes  int           `yaml:"max_header_bytes"`
+	MaxBodyBytes    int64         `yaml:"max_body_bytes"`
+	// TrustedProxies are IPs and CIDRs whose X-Forwarded-For gives the client IP,
+	// none by default so the client can't choose its IP for the login limits
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type Log struct {
+	File  string `yaml:"file"`
+	Level string `yaml:"level"`
+}
+
+type JWT struct {
+	// KeysDir holds RS256 and EdDSA PEM keys, it may be empty with the in-memory store only,
+	// then a temporary key is used
+	KeysDir string `yaml:"keys_dir"`
+	// KeyPublishDelay is how long a new key is published before it signs
+	KeyPublishDelay time.Duration `yaml:"key_publish_delay"`
+	KeysReload      time.Duration `yaml:"keys_reload"`
+	// Plain integer timeouts of the environment variables are seconds
+	AccessTokenTimeout  time.Duration `yaml:"access_token_timeout"`
+	RefreshTokenTimeout time.Duration `yaml:"refresh_token_timeout"`
+}
+
+type Login struct {
+	MaxFailures   int           `yaml:"max_failures"`
+	MaxIPFailures int           `yaml:"max_ip_failures"`
+	Backoff       time.Duration `yaml:"backoff"`
+	Lockout       time.Duration `yaml:"lockout"`
+	// RateLimit is requests per second of an IP, 0 is unlimited
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+}
+
+type Device struct {
+	// RateLimit is requests per second of an api key, 0 is unlimited
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+	// DailyQuota is requests of a client per UTC day, 0 is unlimited
+	DailyQuota int64 `yaml:"daily_quota"`
+	// UsageFlushInterval is how often counted requests are saved, other processes see them after it
+	UsageFlushInterval time.Duration `yaml:"usage_flush_interval"`
+	// APIKeyCacheTTL is how long looked up api keys are kept, other processes see revoked keys after it
+	APIKeyCacheTTL time.Duration `yaml:"api_key_cache_ttl"`
+	// Device times may be ahead of the server by ClockSkewWindow and behind by TimeMaxAge
+	ClockSkewWindow time.Duration `yaml:"clock_skew_window"`
+	TimeMaxAge      time.Duration `yaml:"time_max_age"`
+	ClockSkewPolicy string        `yaml:"clock_skew_policy"`
+	SignatureWindow time.Duration `yaml:"signature_window"`
+}
+
+// Default returns the configuration used for the values missing in the file and the environment
+func Default() Config {
+	return Config{
+		Port: "8080",
+		HTTP: HTTP{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+			MaxBodyBytes:      10 << 20,
+		},
+		Log: Log{
+			File:  "./logs/error.log",
+			Level: "info",
+		},
+		JWT: JWT{
+			KeyPublishDelay:     time.Hour,
+			KeysReload:          time.Minute,
+			AccessTokenTimeout:  3 * time.Hour,
+			RefreshTokenTimeout: 30 * 24 * time.Hour,
+		},
+		Login: Login{
+			MaxFailures:   10,
+			MaxIPFailures: 100,
+			Backoff:       time.Second,
+			Lockout:       15 * time.Minute,
+			RateLimit:     1,
+			RateBurst:     10,
+		},
+		Device: Device{
+			RateLimit:          10,
+			RateBurst:          20,
+			UsageFlushInterval: 10 * time.Second,
+			APIKeyCacheTTL:     30 * time.Second,
+			ClockSkewWindow:    5 * time.Minute,
+			TimeMaxAge:         72 * time.Hour,
+			ClockSkewPolicy:    ClockSkewFlag,
+			SignatureWindow:    5 * time.Minute,
+		},
+		DefaultCurrency:   "TMT",
+		IdempotencyKeyTTL: 24 * time.Hour,
+	}
+}
+
+// Load reads the file over the defaults, applies the environment and validates the result.
+// Empty file reads DefaultFile if it exists
+func Load(file string) (Config, error) {
+	config := Default()
+
+	if file == "" {
+		if _, err := os.Stat(DefaultFile); err == nil {
+			file = DefaultFile
+		}
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return Config{}, err
+		}
+		defer f.Close()
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	if err := config.applyEnv(os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+	if currency, err := money.ParseCurrency(config.DefaultCurrency); err == nil {
+		config.DefaultCurrency = currency
+	}
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// envVar is a value of the config set by an environment variable
+type envVar struct {
+	name  string
+	value interface{}
+}
+
+func (c *Config) envVars() []envVar {
+	return []envVar{
+		{"PORT", &c.Port},
+		{"HTTP_READ_HEADER_TIMEOUT", &c.HTTP.ReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", &c.HTTP.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", &c.HTTP.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", &c.HTTP.IdleTimeout},
+		{"HTTP_SHUTDOWN_TIMEOUT", &c.HTTP.ShutdownTimeout},
+		{"HTTP_MAX_HEADER_BYTES", &c.HTTP.MaxHeaderBytes},
+		{"HTTP_MAX_BODY_BYTES", &c.HTTP.MaxBodyBytes},
+		{"HTTP_TRUSTED_PROXIES", &c.HTTP.TrustedProxies},
+		{"DATABASE_URL", &c.DatabaseURL},
+		{"LOG_FILE", &c.Log.File},
+		{"LOG_LEVEL", &c.Log.Level},
+		{"JWT_KEYS_DIR", &c.JWT.KeysDir},
+		{"JWT_KEY_PUBLISH_DELAY", &c.JWT.KeyPublishDelay},
+		{"JWT_KEYS_RELOAD", &c.JWT.KeysReload},
+		{"ACCESS_TOKEN_TIMEOUT", &c.JWT.AccessTokenTimeout},
+		{"REFRESH_TOKEN_TIMEOUT", &c.JWT.RefreshTokenTimeout},
+		{"LOGIN_MAX_FAILURES", &c.Login.MaxFailures},
+		{"LOGIN_MAX_IP_FAILURES", &c.Login.MaxIPFailures},
+		{"LOGIN_BACKOFF", &c.Login.Backoff},
+		{"LOGIN_LOCKOUT", &c.Login.Lockout},
+		{"LOGIN_RATE_LIMIT", &c.Login.RateLimit},
+		{"LOGIN_RATE_BURST", &c.Login.RateBurst},
+		{"DEVICE_RATE_LIMIT", &c.Device.RateLimit},
+		{"DEVICE_RATE_BURST", &c.Device.RateBurst},
+		{"DEVICE_DAILY_QUOTA", &c.Device.DailyQuota},
+		{"DEVICE_USAGE_FLUSH_INTERVAL", &c.Device.UsageFlushInterval},
+		{"API_KEY_CACHE_TTL", &c.Device.APIKeyCacheTTL},
+		{"CLOCK_SKEW_WINDOW", &c.Device.ClockSkewWindow},
+		{"DEVICE_TIME_MAX_AGE", &c.Device.TimeMaxAge},
+		{"CLOCK_SKEW_POLICY", &c.Device.ClockSkewPolicy},
+		{"SIGNATURE_WINDOW", &c.Device.SignatureWindow},
+		{"DEFAULT_CURRENCY", &c.DefaultCurrency},
+		{"IDEMPOTENCY_KEY_TTL", &c.IdempotencyKeyTTL},
+	}
+}
+
+// applyEnv overrides the values with non-empty environment variables
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, v := range c.envVars() {
+		value, ok := lookup(v.name)
+		if !ok || value == "" {
+			continue
+		}
+		var err error
+		switch p := v.value.(type) {
+		case *string:
+			*p = value
+		case *[]string:
+			*p = strings.Split(value, ",")
+			for i := range *p {
+				(*p)[i] = strings.TrimSpace((*p)[i])
+			}
+		case *int:
+			*p, err = strconv.Atoi(value)
+		case *int64:
+			*p, err = strconv.ParseInt(value, 10, 64)
+		case *float64:
+			*p, err = strconv.ParseFloat(value, 64)
+		case *time.Duration:
+			*p, err = parseDuration(value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+// parseDuration parses durations like 3h, plain integers are seconds
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Validate returns all problems of the config as one error
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "port %q must be a number between 1 and 65535", c.Port)
+	check(c.HTTP.ReadHeaderTimeout > 0, "http.read_header_timeout must be positive")
+	check(c.HTTP.ReadTimeout >= c.HTTP.ReadHeaderTimeout, "http.read_timeout can't be shorter than http.read_header_timeout")
+	check(c.HTTP.WriteTimeout > 0, "http.write_timeout must be positive")
+	check(c.HTTP.IdleTimeout > 0, "http.idle_timeout must be positive")
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout must be positive")
+	check(c.HTTP.MaxHeaderBytes >= 4<<10, "http.max_header_bytes must be at least 4096")
+	check(c.HTTP.MaxBodyBytes >= 4<<10, "http.max_body_bytes must be at least 4096")
+	for _, proxy := range c.HTTP.TrustedProxies {
+		_, _, err := net.ParseCIDR(proxy)
+		check(err == nil || net.ParseIP(proxy) != nil, "http.trusted_proxies %q isn't an IP or a CIDR", proxy)
+	}
+	if c.DatabaseURL != MemoryURL {
+		u, err := url.Parse(c.DatabaseURL)
+		check(err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql"), "database_url must be a postgres:// url or %s", MemoryURL)
+	}
+	check(c.Log.File != "", "log.file can't be empty")
+	_, err = zapcore.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level %q is unknown", c.Log.Level)
+
+	check(c.JWT.KeysDir != "" || c.DatabaseURL == MemoryURL, "jwt.keys_dir can't be empty, tokens would be signed with a temporary key")
+	check(c.JWT.KeyPublishDelay >= 0, "jwt.key_publish_delay can't be negative")
+	check(c.JWT.KeysReload > 0, "jwt.keys_reload must be positive")
+	check(c.JWT.AccessTokenTimeout >= time.Minute, "jwt.access_token_timeout must be at least 1m")
+	check(c.JWT.RefreshTokenTimeout > c.JWT.AccessTokenTimeout, "jwt.refresh_token_timeout must be longer than jwt.access_token_timeout")
+
+	check(c.Login.MaxFailures > 0, "login.max_failures must be positive")
+	check(c.Login.MaxIPFailures >= c.Login.MaxFailures, "login.max_ip_failures can't be less than login.max_failures")
+	check(c.Login.Backoff > 0, "login.backoff must be positive")
+	check(c.Login.Lockout >= c.Login.Backoff, "login.lockout can't be shorter than login.backoff")
+	check(c.Login.RateLimit >= 0, "login.rate_limit can't be negative")
+	check(c.Login.RateBurst > 0, "login.rate_burst must be positive")
+
+	check(c.Device.RateLimit >= 0, "device.rate_limit can't be negative")
+	check(c.Device.RateBurst > 0, "device.rate_burst must be positive")
+	check(c.Device.DailyQuota >= 0, "device.daily_quota can't be negative")
+	check(c.Device.UsageFlushInterval > 0, "device.usage_flush_interval must be positive")
+	check(c.Device.APIKeyCacheTTL >= 0, "device.api_key_cache_ttl can't be negative")
+	check(c.Device.ClockSkewWindow >= 0, "device.clock_skew_window can't be negative")
+	check(c.Device.TimeMaxAge >= 0, "device.time_max_age can't be negative")
+	check(c.Device.ClockSkewPolicy == ClockSkewFlag || c.Device.ClockSkewPolicy == ClockSkewReject,
+		"device.clock_skew_policy %q is unknown, available policies: %s, %s", c.Device.ClockSkewPolicy, ClockSkewFlag, ClockSkewReject)
+	check(c.Device.SignatureWindow > 0, "device.signature_window must be positive")
+
+	_, err = money.ParseCurrency(c.DefaultCurrency)
+	check(err == nil, "default_currency %q isn't an ISO 4217 code", c.DefaultCurrency)
+	check(c.IdempotencyKeyTTL > 0, "idempotency_key_ttl must be positive")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Values returns the config as environment variables, the database password is hidden
+func (c Config) Values() []string {
+	values := make([]string, 0, len(c.envVars()))
+	for _, v := range c.envVars() {
+		var value interface{}
+		switch p := v.value.(type) {
+		case *string:
+			value = *p
+		case *[]string:
+			value = strings.Join(*p, ",")
+		case *int:
+			value = *p
+		case *int64:
+			value = *p
+		case *float64:
+			value = *p
+		case *time.Duration:
+			value = p.String()
+		}
+		if v.name == "DATABASE_URL" {
+			value = redactURL(c.DatabaseURL)
+		}
+		values = append(values, fmt.Sprintf("%s=%v", v.name, value))
+	}
+	return values
+}
+
+// redactURL hides the password of the url
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); !ok {
+		return rawURL
+	}
+	return u.Redacted()
+}
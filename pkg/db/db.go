@@ -3,15 +3,15 @@ package db
 import (
 	"context"
 	"gocash/pkg/logger"
-	"os"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var DB *pgxpool.Pool
 
-func CreateDB() *pgxpool.Pool {
-	dbpool, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
+// CreateDB connects to the postgres database of the url
+func CreateDB(databaseURL string) *pgxpool.Pool {
+	dbpool, err := pgxpool.New(context.Background(), databaseURL)
 	if err != nil {
 		logger.Fatalf("Failed to create new pool %v", err)
 	}
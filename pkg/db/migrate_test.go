@@ -0,0 +1,44 @@
+package db
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations")
+	}
+
+	// Versions start at 1 without gaps, so a missing file is noticed
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d_%s, want version %d", m.Version, m.Name, i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("migration %d_%s misses the up or down script", m.Version, m.Name)
+		}
+	}
+
+	// Every file belongs to a migration
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2*len(migrations) {
+		t.Errorf("%d files for %d migrations", len(files), len(migrations))
+	}
+	for _, m := range migrations {
+		for _, direction := range []string{"up", "down"} {
+			file := fmt.Sprintf("migrations/%04d_%s.%s.sql", m.Version, m.Name, direction)
+			if _, err := fs.Stat(migrationFiles, file); err != nil {
+				t.Errorf("migration %d_%s: %v", m.Version, m.Name, err)
+			}
+		}
+	}
+}
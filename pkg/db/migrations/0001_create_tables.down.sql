@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS clients;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS ranges;
+DROP TABLE IF EXISTS cashes;
@@ -1,4 +1,4 @@
-CREATE TABLE cashes (
+CREATE TABLE IF NOT EXISTS cashes (
 	uuid uuid PRIMARY KEY,
 	created_at timestamp NOT NULL,
 	updated_at timestamp NOT NULL,
@@ -9,7 +9,7 @@ CREATE TABLE cashes (
 	note varchar(255)
 );
 
-CREATE TABLE ranges (
+CREATE TABLE IF NOT EXISTS ranges (
 	uuid uuid PRIMARY KEY,
 	created_at timestamp NOT NULL,
 	updated_at timestamp NOT NULL,
@@ -18,14 +18,14 @@ CREATE TABLE ranges (
 	note  varchar(255)
 );
 
-CREATE TABLE users (
+CREATE TABLE IF NOT EXISTS users (
 	username varchar(255) PRIMARY KEY,
 	password varchar(255) NOT NULL,
 	created_at timestamp NOT NULL,
 	updated_at timestamp NOT NULL
 );
 
-CREATE TABLE clients (
+CREATE TABLE IF NOT EXISTS clients (
 	api_key uuid PRIMARY KEY,
 	name varchar(255) NOT NULL
 );
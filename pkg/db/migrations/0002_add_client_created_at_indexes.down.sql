@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS ranges_client_created_at_idx;
+DROP INDEX IF EXISTS cashes_client_created_at_idx;
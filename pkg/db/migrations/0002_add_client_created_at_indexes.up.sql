@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS cashes_client_created_at_idx ON cashes (client, created_at);
+CREATE INDEX IF NOT EXISTS ranges_client_created_at_idx ON ranges (client, created_at);
@@ -0,0 +1 @@
+ALTER TABLE cashes ALTER COLUMN amount TYPE numeric USING amount / 100.0;
@@ -0,0 +1,2 @@
+-- Amounts are kept as integer minor units, e.g. 12.50 is 1250
+ALTER TABLE cashes ALTER COLUMN amount TYPE bigint USING round(amount * 100);
@@ -0,0 +1,3 @@
+-- Existing cashes have been collected in manat
+ALTER TABLE cashes ADD COLUMN currency char(3) NOT NULL DEFAULT 'TMT';
+ALTER TABLE cashes ALTER COLUMN currency DROP DEFAULT;
@@ -0,0 +1,16 @@
+-- Denominations without client are defaults of the currency for every client
+CREATE TABLE denominations (
+	client varchar(255),
+	currency char(3) NOT NULL,
+	value bigint NOT NULL CHECK (value > 0)
+);
+
+CREATE UNIQUE INDEX denominations_client_currency_value_idx ON denominations (COALESCE(client, ''), currency, value);
+
+INSERT INTO denominations (client, currency, value) VALUES
+	(NULL, 'TMT', 100),
+	(NULL, 'TMT', 500),
+	(NULL, 'TMT', 1000),
+	(NULL, 'TMT', 2000),
+	(NULL, 'TMT', 5000),
+	(NULL, 'TMT', 10000);
@@ -0,0 +1,2 @@
+DROP TABLE range_denominations;
+DROP TABLE range_totals;
@@ -0,0 +1,42 @@
+-- Totals of a range are computed once when the range is closed
+CREATE TABLE range_totals (
+	range_uuid uuid NOT NULL REFERENCES ranges (uuid) ON DELETE CASCADE,
+	currency char(3) NOT NULL,
+	total_amount bigint NOT NULL,
+	PRIMARY KEY (range_uuid, currency)
+);
+
+CREATE TABLE range_denominations (
+	range_uuid uuid NOT NULL,
+	currency char(3) NOT NULL,
+	value bigint NOT NULL,
+	count bigint NOT NULL,
+	total_amount bigint NOT NULL,
+	PRIMARY KEY (range_uuid, currency, value),
+	FOREIGN KEY (range_uuid, currency) REFERENCES range_totals (range_uuid, currency) ON DELETE CASCADE
+);
+
+-- Snapshot existing ranges, every range starts after the previous range of its client,
+-- so a cash on a range boundary is counted once, in the earlier range as 0007 assigns it
+CREATE TEMPORARY TABLE range_bounds ON COMMIT DROP AS
+SELECT r.uuid, r.client, r.created_at,
+	COALESCE(LAG(r.created_at) OVER (PARTITION BY r.client ORDER BY r.created_at), '2001-12-28') AS started_at
+FROM ranges r;
+
+INSERT INTO range_totals (range_uuid, currency, total_amount)
+SELECT b.uuid, c.currency, SUM(c.amount)
+FROM range_bounds b
+JOIN cashes c ON c.client = b.client AND c.created_at > b.started_at AND c.created_at <= b.created_at
+GROUP BY b.uuid, c.currency;
+
+INSERT INTO range_denominations (range_uuid, currency, value, count, total_amount)
+SELECT t.range_uuid, t.currency, d.value, COUNT(c.amount), COALESCE(SUM(c.amount), 0)
+FROM range_totals t
+JOIN range_bounds b ON b.uuid = t.range_uuid
+JOIN denominations d ON d.currency = t.currency AND (
+	d.client = b.client OR
+	d.client IS NULL AND NOT EXISTS (SELECT 1 FROM denominations o WHERE o.client = b.client AND o.currency = t.currency)
+)
+LEFT JOIN cashes c ON c.client = b.client AND c.currency = t.currency AND c.amount = d.value
+	AND c.created_at > b.started_at AND c.created_at <= b.created_at
+GROUP BY t.range_uuid, t.currency, d.value;
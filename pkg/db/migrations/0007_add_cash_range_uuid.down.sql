@@ -0,0 +1 @@
+ALTER TABLE cashes DROP COLUMN range_uuid;
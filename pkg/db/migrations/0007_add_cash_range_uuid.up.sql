@@ -0,0 +1,15 @@
+-- Cashes are assigned to the range which closes them instead of timestamp windows
+ALTER TABLE cashes ADD COLUMN range_uuid uuid REFERENCES ranges (uuid);
+
+-- Existing cashes go to the first range of the client created at or after them,
+-- so a cash on a range boundary belongs to only one range.
+-- Snapshots of settled ranges are kept as they are
+UPDATE cashes c SET range_uuid = (
+	SELECT r.uuid FROM ranges r
+	WHERE r.client = c.client AND r.created_at >= c.created_at
+	ORDER BY r.created_at
+	LIMIT 1
+);
+
+CREATE INDEX cashes_range_uuid_idx ON cashes (range_uuid);
+CREATE INDEX cashes_client_open_idx ON cashes (client) WHERE range_uuid IS NULL;
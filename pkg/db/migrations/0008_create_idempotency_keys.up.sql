@@ -0,0 +1,10 @@
+CREATE TABLE idempotency_keys (
+	client varchar(255) NOT NULL,
+	resource varchar(32) NOT NULL,
+	key varchar(255) NOT NULL,
+	resource_uuid uuid NOT NULL,
+	created_at timestamp NOT NULL,
+	PRIMARY KEY (client, resource, key)
+);
+
+CREATE INDEX idempotency_keys_client_created_at_idx ON idempotency_keys (client, created_at);
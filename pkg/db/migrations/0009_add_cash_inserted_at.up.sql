@@ -0,0 +1,2 @@
+-- Time the device has accepted the note, created_at stays the time the server has received it
+ALTER TABLE cashes ADD COLUMN inserted_at timestamp;
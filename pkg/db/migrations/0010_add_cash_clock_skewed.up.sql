@@ -0,0 +1,2 @@
+-- Set when the device time is outside of the allowed clock skew window
+ALTER TABLE cashes ADD COLUMN clock_skewed boolean NOT NULL DEFAULT false;
@@ -0,0 +1,4 @@
+ALTER TABLE cashes
+	DROP COLUMN voided_at,
+	DROP COLUMN voided_by,
+	DROP COLUMN void_reason;
@@ -0,0 +1,5 @@
+-- Voided cashes are kept but excluded from range totals and reports
+ALTER TABLE cashes
+	ADD COLUMN voided_at timestamp,
+	ADD COLUMN voided_by varchar(255),
+	ADD COLUMN void_reason text;
@@ -0,0 +1,27 @@
+-- Append-only log of mutating operations
+CREATE TABLE audit_events (
+	id bigserial PRIMARY KEY,
+	created_at timestamp NOT NULL,
+	action varchar(64) NOT NULL,
+	actor varchar(255) NOT NULL,
+	client varchar(255),
+	ip varchar(64) NOT NULL,
+	user_agent text NOT NULL,
+	resource_uuid uuid,
+	before jsonb,
+	after jsonb
+);
+
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX audit_events_actor_created_at_idx ON audit_events (actor, created_at);
+CREATE INDEX audit_events_action_created_at_idx ON audit_events (action, created_at);
+
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
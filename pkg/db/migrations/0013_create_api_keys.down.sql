@@ -0,0 +1,20 @@
+-- Revoked keys, keys of deleted clients and keys which aren't uuids can't be kept by the old table
+DELETE FROM api_keys WHERE revoked_at IS NOT NULL OR client IN (SELECT name FROM clients WHERE deleted_at IS NOT NULL);
+ALTER TABLE api_keys DROP CONSTRAINT api_keys_client_fkey;
+DROP TABLE clients;
+
+DROP INDEX api_keys_client_idx;
+ALTER TABLE api_keys DROP CONSTRAINT api_keys_pkey;
+ALTER TABLE api_keys DROP CONSTRAINT api_keys_key_key;
+ALTER TABLE api_keys
+	DROP COLUMN uuid,
+	DROP COLUMN label,
+	DROP COLUMN created_at,
+	DROP COLUMN revoked_at,
+	DROP COLUMN last_used_at;
+DELETE FROM api_keys WHERE key !~* '^[0-9a-f]{8}-?[0-9a-f]{4}-?[0-9a-f]{4}-?[0-9a-f]{4}-?[0-9a-f]{12}$';
+ALTER TABLE api_keys ALTER COLUMN key TYPE uuid USING key::uuid;
+ALTER TABLE api_keys RENAME COLUMN key TO api_key;
+ALTER TABLE api_keys RENAME COLUMN client TO name;
+ALTER TABLE api_keys ADD CONSTRAINT clients_pkey PRIMARY KEY (api_key);
+ALTER TABLE api_keys RENAME TO clients;
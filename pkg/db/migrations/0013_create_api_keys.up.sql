@@ -0,0 +1,35 @@
+-- Every client can have several api keys, so keys can be rotated and revoked
+ALTER TABLE clients RENAME TO api_keys;
+ALTER TABLE api_keys RENAME COLUMN name TO client;
+ALTER TABLE api_keys RENAME COLUMN api_key TO key;
+ALTER TABLE api_keys DROP CONSTRAINT clients_pkey;
+ALTER TABLE api_keys ALTER COLUMN key TYPE varchar(255);
+ALTER TABLE api_keys
+	ADD COLUMN uuid uuid,
+	ADD COLUMN label varchar(255) NOT NULL DEFAULT '',
+	ADD COLUMN created_at timestamp,
+	ADD COLUMN revoked_at timestamp,
+	ADD COLUMN last_used_at timestamp;
+UPDATE api_keys SET uuid = md5(random()::text || clock_timestamp()::text || key)::uuid, created_at = now();
+ALTER TABLE api_keys
+	ALTER COLUMN uuid SET NOT NULL,
+	ALTER COLUMN created_at SET NOT NULL,
+	ADD PRIMARY KEY (uuid),
+	ADD UNIQUE (key);
+
+CREATE TABLE clients (
+	name varchar(255) PRIMARY KEY,
+	detail varchar(255) NOT NULL DEFAULT '',
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	deleted_at timestamp
+);
+
+-- Clients which only have cashes or ranges are kept too
+INSERT INTO clients (name, created_at, updated_at)
+SELECT client, now(), now() FROM api_keys
+UNION SELECT client, now(), now() FROM cashes
+UNION SELECT client, now(), now() FROM ranges;
+
+ALTER TABLE api_keys ADD FOREIGN KEY (client) REFERENCES clients (name);
+CREATE INDEX api_keys_client_idx ON api_keys (client);
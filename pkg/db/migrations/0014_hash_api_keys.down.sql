@@ -0,0 +1,7 @@
+-- Hashed keys can't be restored, clients need new keys after this
+DELETE FROM api_keys;
+DROP INDEX api_keys_prefix_idx;
+ALTER TABLE api_keys
+	DROP COLUMN prefix,
+	DROP COLUMN key_hash,
+	ADD COLUMN key varchar(255) NOT NULL UNIQUE;
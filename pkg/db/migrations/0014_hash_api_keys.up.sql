@@ -0,0 +1,12 @@
+-- Keys are found by their prefix and checked by sha256 hash, plaintext keys aren't kept
+ALTER TABLE api_keys
+	ADD COLUMN prefix varchar(12),
+	ADD COLUMN key_hash char(64);
+UPDATE api_keys SET prefix = left(key, 12), key_hash = encode(sha256(convert_to(key, 'UTF8')), 'hex');
+ALTER TABLE api_keys
+	ALTER COLUMN prefix SET NOT NULL,
+	ALTER COLUMN key_hash SET NOT NULL,
+	ADD UNIQUE (key_hash),
+	DROP COLUMN key;
+
+CREATE INDEX api_keys_prefix_idx ON api_keys (prefix);
@@ -0,0 +1,4 @@
+DROP TABLE request_nonces;
+ALTER TABLE clients
+	DROP COLUMN signing_secret,
+	DROP COLUMN signature_required;
@@ -0,0 +1,14 @@
+-- HMAC secret of the client, it's kept readable since signatures are verified with it
+ALTER TABLE clients
+	ADD COLUMN signing_secret varchar(255),
+	ADD COLUMN signature_required boolean NOT NULL DEFAULT false;
+
+-- Nonces of signed requests, kept until their timestamp leaves the signature window
+CREATE TABLE request_nonces (
+	client varchar(255) NOT NULL,
+	nonce varchar(255) NOT NULL,
+	expires_at timestamp NOT NULL,
+	PRIMARY KEY (client, nonce)
+);
+
+CREATE INDEX request_nonces_client_expires_at_idx ON request_nonces (client, expires_at);
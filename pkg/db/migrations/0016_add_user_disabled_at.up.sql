@@ -0,0 +1,2 @@
+-- Disabled users can't log in or refresh tokens
+ALTER TABLE users ADD COLUMN disabled_at timestamp;
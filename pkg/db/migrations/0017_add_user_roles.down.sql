@@ -0,0 +1,2 @@
+DROP TABLE user_clients;
+ALTER TABLE users DROP COLUMN role;
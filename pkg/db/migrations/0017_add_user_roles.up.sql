@@ -0,0 +1,10 @@
+-- Existing users keep full access, new users are viewers unless a role is given
+ALTER TABLE users ADD COLUMN role varchar(32) NOT NULL DEFAULT 'admin';
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'viewer';
+
+-- Users with assigned clients see only cashes and ranges of those clients
+CREATE TABLE user_clients (
+	username varchar(255) NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+	client varchar(255) NOT NULL REFERENCES clients (name),
+	PRIMARY KEY (username, client)
+);
@@ -0,0 +1,13 @@
+-- Refresh tokens are rotated on every use, tokens issued by one login share a family
+CREATE TABLE refresh_tokens (
+	id uuid PRIMARY KEY,
+	family uuid NOT NULL,
+	username varchar(255) NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+	created_at timestamp NOT NULL,
+	expires_at timestamp NOT NULL,
+	used_at timestamp,
+	revoked_at timestamp
+);
+
+CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family);
+CREATE INDEX refresh_tokens_username_idx ON refresh_tokens (username);
@@ -0,0 +1,6 @@
+-- Failed logins counted per username and per IP, key is user:<username> or ip:<address>
+CREATE TABLE login_attempts (
+	key varchar(300) PRIMARY KEY,
+	failures integer NOT NULL,
+	last_failure_at timestamp NOT NULL
+);
@@ -0,0 +1,16 @@
+-- TOTP secret is pending until the first code confirms it, totp_last_step keeps codes single use
+ALTER TABLE users ADD COLUMN totp_secret varchar(64);
+ALTER TABLE users ADD COLUMN totp_enabled_at timestamp;
+ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+	username varchar(255) NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+	code_hash varchar(64) NOT NULL,
+	used_at timestamp,
+	PRIMARY KEY (username, code_hash)
+);
+
+-- Users of these roles can't log in without two-factor authentication
+CREATE TABLE two_factor_roles (
+	role varchar(32) PRIMARY KEY
+);
@@ -0,0 +1,4 @@
+DROP TABLE api_key_usage;
+ALTER TABLE clients DROP COLUMN daily_quota;
+ALTER TABLE clients DROP COLUMN rate_burst;
+ALTER TABLE clients DROP COLUMN rate_limit;
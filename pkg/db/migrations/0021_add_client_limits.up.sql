@@ -0,0 +1,15 @@
+-- Rate limits and daily quotas of the clients, NULL uses the service defaults
+ALTER TABLE clients ADD COLUMN rate_limit double precision;
+ALTER TABLE clients ADD COLUMN rate_burst integer;
+ALTER TABLE clients ADD COLUMN daily_quota bigint;
+
+-- Device requests per api key and UTC day
+CREATE TABLE api_key_usage (
+	api_key uuid NOT NULL,
+	client varchar(255) NOT NULL REFERENCES clients (name),
+	day date NOT NULL,
+	requests bigint NOT NULL,
+	PRIMARY KEY (api_key, day)
+);
+
+CREATE INDEX api_key_usage_client_day_idx ON api_key_usage (client, day);
@@ -0,0 +1,7 @@
+-- Login challenge tokens which have been exchanged, kept until the tokens expire
+CREATE TABLE used_challenges (
+	id uuid PRIMARY KEY,
+	expires_at timestamp NOT NULL
+);
+
+CREATE INDEX used_challenges_expires_at_idx ON used_challenges (expires_at);
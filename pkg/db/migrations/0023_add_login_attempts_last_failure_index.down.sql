@@ -0,0 +1 @@
+DROP INDEX login_attempts_last_failure_at_idx;
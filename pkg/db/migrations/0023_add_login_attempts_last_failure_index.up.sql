@@ -0,0 +1,2 @@
+-- Stale counters are deleted by the time of their last failure
+CREATE INDEX login_attempts_last_failure_at_idx ON login_attempts (last_failure_at);
@@ -0,0 +1,291 @@
+package keyset
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Algorithms of the generated keys
+const (
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// rsaBits is size of the generated RSA keys
+const rsaBits = 2048
+
+// keyExt is the file extension of the keys in the directory
+const keyExt = ".pem"
+
+// kidTimeLayout is the creation time at the end of the kids, it orders the keys
+// so copied or restored files keep their order
+const kidTimeLayout = "20060102T150405Z"
+
+// Key is a private signing key, ID is the kid header of the tokens it signs
+type Key struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Private   crypto.Signer
+	CreatedAt time.Time
+}
+
+// KeySet holds the signing keys of a directory. Every key verifies tokens,
+// the newest key published for PublishDelay signs them, so verifiers have
+// seen a new key in JWKS before the first token signed with it
+type KeySet struct {
+	dir          string
+	publishDelay time.Duration
+
+	mu   sync.RWMutex
+	keys []Key
+}
+
+// Load reads PEM encoded RSA and Ed25519 private keys of the directory,
+// kid of a key is its file name without the extension like eddsa-20230102T150405Z
+func Load(dir string, publishDelay time.Duration) (*KeySet, error) {
+	s := &KeySet{dir: dir, publishDelay: publishDelay}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Ephemeral creates a set with a single Ed25519 key kept in memory,
+// its tokens are invalid after restart
+func Ephemeral() (*KeySet, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySet{keys: []Key{{
+		ID:        "ephemeral",
+		Method:    jwt.SigningMethodEdDSA,
+		Private:   private,
+		CreatedAt: time.Now(),
+	}}}, nil
+}
+
+// Reload reads the directory again, so generated keys are published and removed keys are retired
+func (s *KeySet) Reload() error {
+	if s.dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]Key, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != keyExt {
+			continue
+		}
+		key, err := readKey(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no %s keys in %s", keyExt, s.dir)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// Refresh reloads the directory every interval, errors keep the previous keys
+func (s *KeySet) Refresh(interval time.Duration, onError func(error)) {
+	for range time.Tick(interval) {
+		if err := s.Reload(); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// Signing returns the newest key published for the publish delay,
+// the oldest key when none is published yet
+func (s *KeySet) Signing() Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	signing := s.keys[0]
+	published := time.Now().Add(-s.publishDelay)
+	for _, key := range s.keys[1:] {
+		if key.CreatedAt.After(published) {
+			break
+		}
+		signing = key
+	}
+	return signing
+}
+
+// Sign signs the claims with the signing key and sets kid header
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key := s.Signing()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc finds the verification key by kid header, tokens signed with
+// other algorithm than the key's are rejected
+func (s *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.ID != kid {
+			continue
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return key.Private.Public(), nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 curve and public key
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys of the set
+func (s *KeySet) JWKS() []JWK {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks := make([]JWK, 0, len(s.keys))
+	for _, key := range s.keys {
+		jwk := JWK{ID: key.ID, Use: "sig", Algorithm: key.Method.Alg()}
+		switch public := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encode(public.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = encode(public)
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+// Generate writes a new key of the algorithm into the directory and returns its kid
+func Generate(dir, algorithm string) (string, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case RS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaBits)
+	case EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", fmt.Errorf("unknown algorithm %q, available algorithms: %s, %s", algorithm, RS256, EdDSA)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	kid := strings.ToLower(algorithm) + "-" + time.Now().UTC().Format(kidTimeLayout)
+	path := filepath.Join(dir, kid+keyExt)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return "", err
+	}
+	return kid, file.Close()
+}
+
+// readKey parses PKCS #8 or PKCS #1 private key, creation time of the key is the end of its kid
+func readKey(path string) (Key, error) {
+	id := strings.TrimSuffix(filepath.Base(path), keyExt)
+	createdAt, err := kidTime(id)
+	if err != nil {
+		return Key{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("no PEM block")
+	}
+
+	var private interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	key := Key{
+		ID:        id,
+		CreatedAt: createdAt,
+	}
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private = jwt.SigningMethodRS256, private
+	case ed25519.PrivateKey:
+		key.Method, key.Private = jwt.SigningMethodEdDSA, private
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %T", private)
+	}
+	return key, nil
+}
+
+// kidTime returns the creation time at the end of the kid
+func kidTime(kid string) (time.Time, error) {
+	i := strings.LastIndex(kid, "-")
+	createdAt, err := time.Parse(kidTimeLayout, kid[i+1:])
+	if i < 0 || err != nil {
+		return time.Time{}, fmt.Errorf("key name %q must end with the creation time like -%s, create keys with `gocash keys generate`", kid, kidTimeLayout)
+	}
+	return createdAt, nil
+}
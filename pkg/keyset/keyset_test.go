@@ -0,0 +1,182 @@
+package keyset
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// writeKey writes a new Ed25519 key created at the time into the directory and returns its kid
+func writeKey(t *testing.T, dir string, createdAt time.Time) string {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := "eddsa-" + createdAt.UTC().Format(kidTimeLayout)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+keyExt), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return kid
+}
+
+// verify parses the token with the keys of the set
+func verify(s *KeySet, token string) error {
+	_, err := jwt.Parse(token, s.Keyfunc)
+	return err
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := writeKey(t, dir, now.Add(-48*time.Hour))
+
+	s, err := Load(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := s.Signing().ID; kid != old {
+		t.Fatalf("signing key %s, want %s", kid, old)
+	}
+	oldToken, err := s.Sign(jwt.RegisteredClaims{Subject: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new key is published in JWKS, but doesn't sign until the publish delay passes
+	fresh := writeKey(t, dir, now.Add(-time.Minute))
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kid := s.Signing().ID; kid != old {
+		t.Errorf("signing key %s before the publish delay, want %s", kid, old)
+	}
+	if jwks := s.JWKS(); len(jwks) != 2 || jwks[0].ID != old || jwks[1].ID != fresh {
+		t.Errorf("JWKS %+v, want %s and %s", jwks, old, fresh)
+	}
+
+	published := writeKey(t, dir, now.Add(-2*time.Hour))
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kid := s.Signing().ID; kid != published {
+		t.Errorf("signing key %s after the publish delay, want %s", kid, published)
+	}
+	newToken, err := s.Sign(jwt.RegisteredClaims{Subject: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if err := verify(s, token); err != nil {
+			t.Errorf("token isn't valid: %v", err)
+		}
+	}
+
+	// Tokens of a removed key are rejected
+	if err := os.Remove(filepath.Join(dir, old+keyExt)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(s, oldToken); err == nil {
+		t.Errorf("token of the removed key is valid")
+	}
+	if err := verify(s, newToken); err != nil {
+		t.Errorf("token isn't valid after reload: %v", err)
+	}
+}
+
+func TestReloadKeepsKeysOnError(t *testing.T) {
+	dir := t.TempDir()
+	kid := writeKey(t, dir, time.Now().Add(-time.Hour))
+	s, err := Load(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "copied"+keyExt), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Errorf("key without the creation time is loaded")
+	}
+	if got := s.Signing().ID; got != kid {
+		t.Errorf("signing key %s after failed reload, want %s", got, kid)
+	}
+}
+
+func TestKeyfunc(t *testing.T) {
+	s, err := Ephemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.Sign(jwt.RegisteredClaims{Subject: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(s, token); err != nil {
+		t.Errorf("token isn't valid: %v", err)
+	}
+
+	other, err := Ephemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(other, token); err == nil {
+		t.Errorf("token of other key with the same kid is valid")
+	}
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.RegisteredClaims{})
+	unknown.Header["kid"] = "unknown"
+	signed, err := unknown.SignedString(s.Signing().Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(s, signed); err == nil {
+		t.Errorf("token of unknown kid is valid")
+	}
+
+	// A HMAC token must not be verified with the public key as the secret
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{})
+	hmac.Header["kid"] = s.Signing().ID
+	signed, err = hmac.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(s, signed); err == nil {
+		t.Errorf("token of other algorithm is valid")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	for _, algorithm := range []string{RS256, EdDSA} {
+		kid, err := Generate(dir, algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := readKey(filepath.Join(dir, kid+keyExt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Method.Alg() != algorithm || time.Since(key.CreatedAt) > time.Minute {
+			t.Errorf("key %s is %s created at %s", kid, key.Method.Alg(), key.CreatedAt)
+		}
+	}
+	if _, err := Generate(dir, "HS256"); err == nil {
+		t.Errorf("HS256 key is generated")
+	}
+}
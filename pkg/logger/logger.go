@@ -1,7 +1,7 @@
 package logger
 
 import (
-	"time"
+	"os"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -12,15 +12,26 @@ import (
 var Logger *zap.SugaredLogger
 
 func init() {
-	config := zap.NewProductionConfig()
-	config.OutputPaths = []string{"./logs/error.log"}
-	config.EncoderConfig.TimeKey = "timestamp"
-	config.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.RFC3339)
+	Logger = zap.New(zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.Lock(os.Stderr),
+		zap.InfoLevel,
+	)).Sugar()
+}
 
-	config.EncoderConfig.StacktraceKey = ""
+// Init replaces the default logger, which writes to stderr, with one writing to the file from the level
+func Init(file, level string) error {
+	l, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Logger = newLogger(file, l)
+	return nil
+}
 
+func newLogger(file string, level zapcore.Level) *zap.SugaredLogger {
 	w := zapcore.AddSync(&lumberjack.Logger{
-		Filename:   "./logs/error.log",
+		Filename:   file,
 		MaxSize:    10, //MB
 		MaxBackups: 30,
 		MaxAge:     30, //days
@@ -30,13 +41,10 @@ func init() {
 	core := zapcore.NewCore(
 		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
 		w,
-		zap.InfoLevel,
+		level,
 	)
 
-	logger := zap.New(core)
-
-	Logger = logger.Sugar()
-
+	return zap.New(core).Sugar()
 }
 
 func Error(args ...interface{}) {
@@ -0,0 +1,120 @@
+package money
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Scale is count of digits after the decimal point
+const Scale = 2
+
+// unit is count of minor units in one major unit
+const unit = 100
+
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Amount is an exact money amount in minor units, e.g. 12.50 is 1250.
+// JSON encodes it as a decimal string and decodes from a decimal string or number
+type Amount int64
+
+// Parse converts decimal string like "12", "12.5" or "-12.50" to amount.
+// More than Scale digits after the decimal point isn't allowed
+func Parse(s string) (Amount, error) {
+	str := strings.TrimSpace(s)
+	negative := strings.HasPrefix(str, "-")
+	str = strings.TrimPrefix(strings.TrimPrefix(str, "-"), "+")
+
+	major, minor, hasPoint := strings.Cut(str, ".")
+	if major == "" && minor == "" || hasPoint && minor == "" || !isDigits(major) || !isDigits(minor) || len(minor) > Scale {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	minor += strings.Repeat("0", Scale-len(minor))
+
+	majorUnits := int64(0)
+	if major != "" {
+		var err error
+		majorUnits, err = strconv.ParseInt(major, 10, 64)
+		if err != nil || majorUnits > math.MaxInt64/unit-1 {
+			return 0, fmt.Errorf("%w: %q is out of range", ErrInvalidAmount, s)
+		}
+	}
+	minorUnits, _ := strconv.ParseInt(minor, 10, 64)
+
+	amount := Amount(majorUnits*unit + minorUnits)
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats amount as decimal string with Scale digits after the decimal point
+func (a Amount) String() string {
+	sign := ""
+	v := int64(a)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, v/unit, Scale, v%unit)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	// Numbers are parsed from their literal text, so 12.1 is never rounded through float64
+	str := string(data)
+	if strings.HasPrefix(str, `"`) {
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+	} else if strings.ContainsAny(str, "eE") {
+		return fmt.Errorf("%w: exponent isn't supported %s", ErrInvalidAmount, str)
+	}
+
+	amount, err := Parse(str)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// Value stores amount as integer minor units
+func (a Amount) Value() (driver.Value, error) {
+	return int64(a), nil
+}
+
+// Scan reads amount from integer minor units
+func (a *Amount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		*a = Amount(v)
+	case int32:
+		*a = Amount(v)
+	default:
+		return fmt.Errorf("couldn't scan %T into amount", src)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+	}{
+		{"12", 1200},
+		{"12.5", 1250},
+		{"12.50", 1250},
+		{"-12.50", -1250},
+		{"+0.01", 1},
+		{".5", 50},
+		{" 7.05 ", 705},
+		{"0", 0},
+		{"92233720368547757.00", 9223372036854775700},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q) error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "-", ".", "12.", "1.234", "1,5", "abc", "1e3", "--1", "92233720368547758"} {
+		if _, err := Parse(in); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("Parse(%q) error %v, want ErrInvalidAmount", in, err)
+		}
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	tests := []struct {
+		amount Amount
+		want   string
+	}{
+		{0, `"0.00"`},
+		{5, `"0.05"`},
+		{1250, `"12.50"`},
+		{-1, `"-0.01"`},
+		{-1250, `"-12.50"`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Marshal(%d) = %s, want %s", tt.amount, got, tt.want)
+		}
+
+		var back Amount
+		if err := json.Unmarshal(got, &back); err != nil || back != tt.amount {
+			t.Errorf("Unmarshal(%s) = %d, %v, want %d", got, back, err, tt.amount)
+		}
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+	}{
+		{`"12.10"`, 1210},
+		{`12.1`, 1210},
+		{`12`, 1200},
+		{`0.29`, 29},
+	}
+	for _, tt := range tests {
+		var got Amount
+		if err := json.Unmarshal([]byte(tt.in), &got); err != nil {
+			t.Errorf("Unmarshal(%s) error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{`1e2`, `"1.001"`, `true`, `"x"`} {
+		var got Amount
+		if err := json.Unmarshal([]byte(in), &got); err == nil {
+			t.Errorf("Unmarshal(%s) = %d, want error", in, got)
+		}
+	}
+}
+
+func TestParseCurrency(t *testing.T) {
+	for in, want := range map[string]string{"usd": "USD", " TMT ": "TMT", "JPY": "JPY"} {
+		if got, err := ParseCurrency(in); err != nil || got != want {
+			t.Errorf("ParseCurrency(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	// Currencies with more minor units than Scale can't be kept exactly
+	for _, in := range []string{"", "XXX", "US", "KWD", "BHD"} {
+		if _, err := ParseCurrency(in); err == nil {
+			t.Errorf("ParseCurrency(%q) is accepted", in)
+		}
+	}
+}
+
+func TestCheckCurrency(t *testing.T) {
+	tests := []struct {
+		amount   Amount
+		currency string
+		valid    bool
+	}{
+		{1250, "USD", true},
+		{1, "USD", true},
+		{50000, "JPY", true},
+		{50050, "JPY", false},
+		{1, "KRW", false},
+	}
+	for _, tt := range tests {
+		err := tt.amount.CheckCurrency(tt.currency)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s %s error %v", tt.amount, tt.currency, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("%s %s error %v, want ErrInvalidAmount", tt.amount, tt.currency, err)
+		}
+	}
+}
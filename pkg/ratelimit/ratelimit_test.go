@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	l := New()
+	limit := Limit{Rate: 2, Burst: 3}
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < limit.Burst; i++ {
+		if ok, _ := l.Allow("a", limit, now); !ok {
+			t.Fatalf("request %d of the burst is limited", i+1)
+		}
+	}
+	ok, wait := l.Allow("a", limit, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("request after the burst = %t, %s, want false, 500ms", ok, wait)
+	}
+
+	// Other keys have their own buckets
+	if ok, _ := l.Allow("b", limit, now); !ok {
+		t.Errorf("other key is limited")
+	}
+
+	// A token is refilled every 1/Rate seconds
+	if ok, wait := l.Allow("a", limit, now.Add(250*time.Millisecond)); ok || wait != 250*time.Millisecond {
+		t.Errorf("request after half a token = %t, %s, want false, 250ms", ok, wait)
+	}
+	if ok, _ := l.Allow("a", limit, now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("request after the refill is limited")
+	}
+
+	// Tokens don't grow past the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < limit.Burst; i++ {
+		if ok, _ := l.Allow("a", limit, later); !ok {
+			t.Fatalf("request %d of the refilled burst is limited", i+1)
+		}
+	}
+	if ok, _ := l.Allow("a", limit, later); ok {
+		t.Errorf("request after the refilled burst is allowed")
+	}
+}
+
+func TestAllowZeroRate(t *testing.T) {
+	l := New()
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a", Limit{}, now); !ok {
+			t.Fatalf("request %d is limited without a rate", i+1)
+		}
+	}
+}
+
+func TestAllowChangedLimit(t *testing.T) {
+	l := New()
+	now := time.Now()
+	if ok, _ := l.Allow("a", Limit{Rate: 1, Burst: 1}, now); !ok {
+		t.Fatal("first request is limited")
+	}
+	if ok, _ := l.Allow("a", Limit{Rate: 1, Burst: 1}, now); ok {
+		t.Fatal("second request is allowed")
+	}
+	// A faster rate refills the bucket sooner
+	if ok, _ := l.Allow("a", Limit{Rate: 10, Burst: 1}, now.Add(100*time.Millisecond)); !ok {
+		t.Errorf("request after the faster refill is limited")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := New()
+	limit := Limit{Rate: 1, Burst: 1}
+	now := time.Now()
+	l.Allow("a", limit, now)
+	for i := 1; i < sweepEvery; i++ {
+		l.Allow("b", limit, now.Add(time.Hour))
+	}
+	if _, found := l.buckets["a"]; found {
+		t.Errorf("full bucket isn't removed")
+	}
+	if _, found := l.buckets["b"]; !found {
+		t.Errorf("used bucket is removed")
+	}
+}
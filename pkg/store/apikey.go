@@ -0,0 +1,20 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// APIKeyPrefixLength is count of the first characters of a key kept to find it
+const APIKeyPrefixLength = 12
+
+// HashAPIKey returns the lookup prefix and the hex encoded sha256 hash of the key.
+// Keys are long random strings, so a fast hash is enough
+func HashAPIKey(key string) (prefix, hash string) {
+	prefix = key
+	if len(prefix) > APIKeyPrefixLength {
+		prefix = prefix[:APIKeyPrefixLength]
+	}
+	sum := sha256.Sum256([]byte(key))
+	return prefix, hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,948 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"gocash/pkg/arrs"
+	"gocash/pkg/money"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Memory is the Store which keeps everything in process memory.
+// It's meant for local development and tests
+type Memory struct {
+	mu      sync.RWMutex
+	clients map[string]Client
+	apiKeys []APIKey
+	users   map[string]User
+	cashes  []Cash
+	ranges  []Range
+	// snapshots are totals of ranges keyed by range uuid
+	snapshots map[uuid.UUID][]CurrencySummary
+	// denominations are keyed by client and currency, empty client is for defaults
+	denominations map[[2]string][]money.Amount
+	// idempotencyKeys are keyed by client, resource and key
+	idempotencyKeys map[[3]string]idempotencyKey
+	auditEvents     []AuditEvent
+	// nonces are expiry times keyed by client and nonce
+	nonces        map[[2]string]time.Time
+	refreshTokens map[uuid.UUID]RefreshToken
+	loginAttempts map[string]LoginAttempt
+	// totpSteps are the last used TOTP steps of the users
+	totpSteps map[string]int64
+	// challenges are expiry times of the used login challenges
+	challenges map[uuid.UUID]time.Time
+	// recoveryCodes are unused recovery code hashes of the users
+	recoveryCodes  map[string][]string
+	twoFactorRoles []string
+	// apiKeyUsage are request counts keyed by api key and UTC day
+	apiKeyUsage map[apiKeyDay]APIKeyUsage
+}
+
+type apiKeyDay struct {
+	apiKey uuid.UUID
+	day    string
+}
+
+type idempotencyKey struct {
+	resourceUUID uuid.UUID
+	createdAt    time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		clients:         map[string]Client{},
+		users:           map[string]User{},
+		snapshots:       map[uuid.UUID][]CurrencySummary{},
+		idempotencyKeys: map[[3]string]idempotencyKey{},
+		nonces:          map[[2]string]time.Time{},
+		refreshTokens:   map[uuid.UUID]RefreshToken{},
+		loginAttempts:   map[string]LoginAttempt{},
+		totpSteps:       map[string]int64{},
+		challenges:      map[uuid.UUID]time.Time{},
+		recoveryCodes:   map[string][]string{},
+		apiKeyUsage:     map[apiKeyDay]APIKeyUsage{},
+		denominations: map[[2]string][]money.Amount{
+			{"", "TMT"}: {1_00, 5_00, 10_00, 20_00, 50_00, 100_00},
+		},
+	}
+}
+
+// AddClient registers client with the given api key
+func (m *Memory) AddClient(apiKey, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[name]; !ok {
+		m.clients[name] = Client{Name: name, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	}
+	prefix, hash := HashAPIKey(apiKey)
+	m.apiKeys = append(m.apiKeys, APIKey{UUID: uuid.New(), Client: name, Prefix: prefix, KeyHash: hash, CreatedAt: time.Now()})
+}
+
+// AddUser saves the user, password must be already hashed
+func (m *Memory) AddUser(user User) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user.Username] = user
+}
+
+func (m *Memory) Close() {}
+
+func (m *Memory) UseAPIKey(ctx context.Context, key string) (APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix, hash := HashAPIKey(key)
+	for i, k := range m.apiKeys {
+		if k.Prefix != prefix || k.KeyHash != hash || k.RevokedAt != nil {
+			continue
+		}
+		if client, ok := m.clients[k.Client]; !ok || client.DeletedAt != nil {
+			return APIKey{}, ErrNotFound
+		}
+		now := time.Now()
+		m.apiKeys[i].LastUsedAt = &now
+		return m.apiKeys[i], nil
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (m *Memory) CreateClient(ctx context.Context, client Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[client.Name]; ok {
+		return ErrConflict
+	}
+	m.clients[client.Name] = client
+	return nil
+}
+
+func (m *Memory) GetClient(ctx context.Context, name string) (Client, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	client, ok := m.clients[name]
+	if !ok || client.DeletedAt != nil {
+		return Client{}, ErrNotFound
+	}
+	return client, nil
+}
+
+func (m *Memory) ListClients(ctx context.Context, offset, limit int) ([]Client, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	clients := make([]Client, 0, len(m.clients))
+	for _, client := range m.clients {
+		if client.DeletedAt == nil {
+			clients = append(clients, client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Name < clients[j].Name
+	})
+	return page(clients, offset, limit), len(clients), nil
+}
+
+func (m *Memory) UpdateClient(ctx context.Context, client Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved, ok := m.clients[client.Name]
+	if !ok || saved.DeletedAt != nil {
+		return ErrNotFound
+	}
+	saved.Detail = client.Detail
+	saved.UpdatedAt = client.UpdatedAt
+	m.clients[client.Name] = saved
+	return nil
+}
+
+func (m *Memory) SetSigningSecret(ctx context.Context, name, secret string, required bool, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[name]
+	if !ok || client.DeletedAt != nil {
+		return ErrNotFound
+	}
+	client.SigningSecret = secret
+	client.SignatureRequired = required
+	client.UpdatedAt = at
+	m.clients[name] = client
+	return nil
+}
+
+func (m *Memory) SetClientLimits(ctx context.Context, name string, limits ClientLimits, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[name]
+	if !ok || client.DeletedAt != nil {
+		return ErrNotFound
+	}
+	client.Limits = limits
+	client.UpdatedAt = at
+	m.clients[name] = client
+	return nil
+}
+
+func (m *Memory) AddAPIKeyUsage(ctx context.Context, usages []APIKeyUsage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, added := range usages {
+		k := apiKeyDay{apiKey: added.APIKey, day: added.Day.Format("2006-01-02")}
+		usage, ok := m.apiKeyUsage[k]
+		if !ok {
+			usage = APIKeyUsage{APIKey: added.APIKey, Client: added.Client, Day: added.Day}
+		}
+		usage.Requests += added.Requests
+		m.apiKeyUsage[k] = usage
+	}
+	return nil
+}
+
+func (m *Memory) ListAPIKeyUsage(ctx context.Context, client string, from, to time.Time) ([]APIKeyUsage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	usages := []APIKeyUsage{}
+	for _, u := range m.apiKeyUsage {
+		if u.Client == client && !u.Day.Before(from) && !u.Day.After(to) {
+			usages = append(usages, u)
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if !usages[i].Day.Equal(usages[j].Day) {
+			return usages[i].Day.Before(usages[j].Day)
+		}
+		return usages[i].APIKey.String() < usages[j].APIKey.String()
+	})
+	return usages, nil
+}
+
+func (m *Memory) ClaimNonce(ctx context.Context, client, nonce string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range m.nonces {
+		if v.Before(now) {
+			delete(m.nonces, k)
+		}
+	}
+	k := [2]string{client, nonce}
+	if _, ok := m.nonces[k]; ok {
+		return ErrConflict
+	}
+	m.nonces[k] = expiresAt
+	return nil
+}
+
+func (m *Memory) DeleteClient(ctx context.Context, name string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[name]
+	if !ok || client.DeletedAt != nil {
+		return ErrNotFound
+	}
+	client.DeletedAt = &at
+	client.UpdatedAt = at
+	m.clients[name] = client
+	for i := range m.apiKeys {
+		if m.apiKeys[i].Client == name && m.apiKeys[i].RevokedAt == nil {
+			m.apiKeys[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *Memory) CreateAPIKey(ctx context.Context, key APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[key.Client]; !ok {
+		return fmt.Errorf("client %s doesn't exist", key.Client)
+	}
+	for _, k := range m.apiKeys {
+		if k.UUID == key.UUID || k.KeyHash == key.KeyHash {
+			return ErrConflict
+		}
+	}
+	m.apiKeys = append(m.apiKeys, key)
+	return nil
+}
+
+func (m *Memory) ListAPIKeys(ctx context.Context, client string) ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]APIKey, 0)
+	for _, k := range m.apiKeys {
+		if k.Client == client {
+			keys = append(keys, k)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (m *Memory) RevokeAPIKey(ctx context.Context, client string, id uuid.UUID, at time.Time) (APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.apiKeys {
+		if m.apiKeys[i].UUID != id || m.apiKeys[i].Client != client {
+			continue
+		}
+		if m.apiKeys[i].RevokedAt == nil {
+			m.apiKeys[i].RevokedAt = &at
+		}
+		return m.apiKeys[i], nil
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (m *Memory) CreateCash(ctx context.Context, cash Cash, idempotency Idempotency) (Cash, bool, error) {
+	results, err := m.CreateCashes(ctx, []CashSubmission{{Cash: cash, Idempotency: idempotency}})
+	if err != nil {
+		return Cash{}, false, err
+	}
+	return results[0].Cash, results[0].Duplicate, nil
+}
+
+func (m *Memory) CreateCashes(ctx context.Context, submissions []CashSubmission) ([]CashResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Roll back everything if one of the cashes fails, only the appended cashes
+	// and the claimed keys are undone
+	cashCount := len(m.cashes)
+	replacedKeys := map[[3]string]*idempotencyKey{}
+	rollback := func() {
+		m.cashes = m.cashes[:cashCount]
+		for k, v := range replacedKeys {
+			if v == nil {
+				delete(m.idempotencyKeys, k)
+			} else {
+				m.idempotencyKeys[k] = *v
+			}
+		}
+	}
+
+	results := make([]CashResult, 0, len(submissions))
+	for _, submission := range submissions {
+		cash := submission.Cash
+		if submission.Idempotency.Key != "" {
+			k := [3]string{cash.Client, "cash", submission.Idempotency.Key}
+			if _, saved := replacedKeys[k]; !saved {
+				replacedKeys[k] = nil
+				if v, ok := m.idempotencyKeys[k]; ok {
+					replacedKeys[k] = &v
+				}
+			}
+		}
+		if originalUUID, claimed := m.claimIdempotencyKey(cash.Client, "cash", submission.Idempotency, cash.UUID); !claimed {
+			original, err := m.getCash(originalUUID)
+			if err != nil {
+				rollback()
+				return nil, err
+			}
+			results = append(results, CashResult{Cash: original, Duplicate: true})
+			continue
+		}
+		if _, err := m.getCash(cash.UUID); err == nil {
+			rollback()
+			return nil, fmt.Errorf("cash %s already exists", cash.UUID)
+		}
+		m.cashes = append(m.cashes, cash)
+		results = append(results, CashResult{Cash: cash})
+	}
+	return results, nil
+}
+
+// claimIdempotencyKey works like the postgres one, m.mu must be locked
+func (m *Memory) claimIdempotencyKey(client, resource string, idempotency Idempotency, id uuid.UUID) (uuid.UUID, bool) {
+	if idempotency.Key == "" {
+		return id, true
+	}
+	k := [3]string{client, resource, idempotency.Key}
+	if v, ok := m.idempotencyKeys[k]; ok && !v.createdAt.Before(idempotency.Since) {
+		return v.resourceUUID, false
+	}
+	m.idempotencyKeys[k] = idempotencyKey{resourceUUID: id, createdAt: time.Now()}
+	return id, true
+}
+
+func (m *Memory) GetCash(ctx context.Context, id uuid.UUID) (Cash, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.getCash(id)
+}
+
+func (m *Memory) getCash(id uuid.UUID) (Cash, error) {
+	for _, c := range m.cashes {
+		if c.UUID == id {
+			return c, nil
+		}
+	}
+	return Cash{}, ErrNotFound
+}
+
+func (m *Memory) VoidCash(ctx context.Context, id uuid.UUID, void Void) (Cash, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.cashes {
+		if m.cashes[i].UUID != id {
+			continue
+		}
+		if m.cashes[i].Void != nil {
+			return Cash{}, ErrAlreadyVoided
+		}
+		if m.cashes[i].RangeUUID != nil {
+			return Cash{}, ErrSettled
+		}
+		m.cashes[i].Void = &void
+		m.cashes[i].UpdatedAt = void.At
+		return m.cashes[i], nil
+	}
+	return Cash{}, ErrNotFound
+}
+
+func (m *Memory) ListCashes(ctx context.Context, filter CashFilter) ([]Cash, int, error) {
+	patterns := map[string]*regexp.Regexp{}
+	for k, v := range filter.Patterns {
+		if !arrs.Contains(CashFilterFields, k) {
+			return nil, 0, fmt.Errorf("unknown cash filter field %s", k)
+		}
+		re, err := regexp.Compile("(?i)" + v)
+		if err != nil {
+			return nil, 0, err
+		}
+		patterns[k] = re
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var filtered []Cash
+	for _, c := range m.cashes {
+		t := filter.Clock.Time(c)
+		if matchCash(c, patterns) &&
+			(len(filter.Amounts) == 0 || arrs.Contains(filter.Amounts, c.Amount)) &&
+			(len(filter.Currencies) == 0 || arrs.Contains(filter.Currencies, c.Currency)) &&
+			(len(filter.Clients) == 0 || arrs.Contains(filter.Clients, c.Client)) &&
+			(filter.IncludeVoided || c.Void == nil) &&
+			(filter.From == nil || !t.Before(*filter.From)) &&
+			(filter.To == nil || t.Before(*filter.To)) {
+			filtered = append(filtered, c)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return filter.Clock.Time(filtered[i]).After(filter.Clock.Time(filtered[j]))
+	})
+
+	return page(filtered, filter.Offset, filter.Limit), len(filtered), nil
+}
+
+func matchCash(c Cash, patterns map[string]*regexp.Regexp) bool {
+	fields := map[string]string{
+		"uuid":       c.UUID.String(),
+		"range_uuid": "",
+		"client":     c.Client,
+		"contact":    c.Contact,
+		"detail":     c.Detail,
+		"note":       c.Note,
+	}
+	if c.RangeUUID != nil {
+		fields["range_uuid"] = c.RangeUUID.String()
+	}
+	for k, re := range patterns {
+		if !re.MatchString(fields[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Memory) CreateRange(ctx context.Context, r Range, idempotency Idempotency) (RangeSummary, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The key isn't claimed for a range which fails, as the postgres transaction is rolled back
+	for _, v := range m.ranges {
+		if v.UUID == r.UUID {
+			return RangeSummary{}, false, fmt.Errorf("range %s already exists", r.UUID)
+		}
+	}
+	if originalUUID, claimed := m.claimIdempotencyKey(r.Client, "range", idempotency, r.UUID); !claimed {
+		for _, v := range m.ranges {
+			if v.UUID == originalUUID {
+				return RangeSummary{Range: v, Totals: m.snapshots[v.UUID]}, true, nil
+			}
+		}
+		return RangeSummary{}, true, ErrNotFound
+	}
+	for i := range m.cashes {
+		if m.cashes[i].Client == r.Client && m.cashes[i].RangeUUID == nil {
+			rangeUUID := r.UUID
+			m.cashes[i].RangeUUID = &rangeUUID
+		}
+	}
+	summary := m.summarizeRange(r)
+	m.ranges = append(m.ranges, r)
+	m.snapshots[r.UUID] = summary.Totals
+	return summary, false, nil
+}
+
+func (m *Memory) ListRanges(ctx context.Context, filter RangeFilter) ([]RangeSummary, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ranges := make([]Range, 0, len(m.ranges))
+	for _, r := range m.ranges {
+		if len(filter.Clients) == 0 || arrs.Contains(filter.Clients, r.Client) {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].CreatedAt.After(ranges[j].CreatedAt)
+	})
+
+	summaries := make([]RangeSummary, 0)
+	for _, r := range page(ranges, filter.Offset, filter.Limit) {
+		summaries = append(summaries, RangeSummary{Range: r, Totals: m.snapshots[r.UUID]})
+	}
+	return summaries, len(ranges), nil
+}
+
+// summarizeRange sums cashes assigned to the range except voided ones
+func (m *Memory) summarizeRange(r Range) RangeSummary {
+	totals := map[string]*CurrencySummary{}
+	for _, c := range m.cashes {
+		if c.RangeUUID == nil || *c.RangeUUID != r.UUID || c.Void != nil {
+			continue
+		}
+		total, ok := totals[c.Currency]
+		if !ok {
+			total = &CurrencySummary{Currency: c.Currency}
+			for _, value := range m.denominationsOf(r.Client, c.Currency) {
+				total.Denominations = append(total.Denominations, DenominationSummary{Value: value})
+			}
+			totals[c.Currency] = total
+		}
+		total.TotalAmount += c.Amount
+		for i := range total.Denominations {
+			if total.Denominations[i].Value == c.Amount {
+				total.Denominations[i].Count++
+				total.Denominations[i].TotalAmount += c.Amount
+			}
+		}
+	}
+
+	summary := RangeSummary{Range: r, Totals: make([]CurrencySummary, 0, len(totals))}
+	for _, total := range totals {
+		summary.Totals = append(summary.Totals, *total)
+	}
+	sort.Slice(summary.Totals, func(i, j int) bool {
+		return summary.Totals[i].Currency < summary.Totals[j].Currency
+	})
+	return summary
+}
+
+func (m *Memory) Denominations(ctx context.Context, client, currency string) ([]money.Amount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.denominationsOf(client, currency), nil
+}
+
+func (m *Memory) denominationsOf(client, currency string) []money.Amount {
+	values, ok := m.denominations[[2]string{client, currency}]
+	if !ok {
+		values = m.denominations[[2]string{"", currency}]
+	}
+	return append([]money.Amount{}, values...)
+}
+
+func (m *Memory) SetDenominations(ctx context.Context, client, currency string, values []money.Amount) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sorted := append([]money.Amount{}, values...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	if len(sorted) == 0 {
+		delete(m.denominations, [2]string{client, currency})
+	} else {
+		m.denominations[[2]string{client, currency}] = sorted
+	}
+	return nil
+}
+
+func (m *Memory) UserByUsername(ctx context.Context, username string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (m *Memory) SetTOTPSecret(ctx context.Context, username, secret string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	user.TOTPSecret = secret
+	user.TOTPEnabledAt = nil
+	user.UpdatedAt = at
+	m.users[username] = user
+	delete(m.totpSteps, username)
+	delete(m.recoveryCodes, username)
+	return nil
+}
+
+func (m *Memory) EnableTOTP(ctx context.Context, username string, step int64, recoveryCodes []string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[username]
+	if !ok || user.TOTPSecret == "" || user.TOTPEnabledAt != nil {
+		return ErrNotFound
+	}
+	user.TOTPEnabledAt = &at
+	user.UpdatedAt = at
+	m.users[username] = user
+	m.totpSteps[username] = step
+	m.recoveryCodes[username] = append([]string(nil), recoveryCodes...)
+	return nil
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, username string, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[username]; !ok || m.totpSteps[username] >= step {
+		return ErrConflict
+	}
+	m.totpSteps[username] = step
+	return nil
+}
+
+func (m *Memory) UseChallenge(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range m.challenges {
+		if v.Before(now) {
+			delete(m.challenges, k)
+		}
+	}
+	if _, ok := m.challenges[id]; ok {
+		return ErrConflict
+	}
+	m.challenges[id] = expiresAt
+	return nil
+}
+
+func (m *Memory) SetRecoveryCodes(ctx context.Context, username string, recoveryCodes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.recoveryCodes[username] = append([]string(nil), recoveryCodes...)
+	return nil
+}
+
+func (m *Memory) UseRecoveryCode(ctx context.Context, username, recoveryCode string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := m.recoveryCodes[username]
+	for i, code := range codes {
+		if code == recoveryCode {
+			m.recoveryCodes[username] = append(codes[:i:i], codes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) TwoFactorRoles(ctx context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]string{}, m.twoFactorRoles...), nil
+}
+
+func (m *Memory) SetTwoFactorRoles(ctx context.Context, roles []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.twoFactorRoles = append([]string(nil), roles...)
+	return nil
+}
+
+func (m *Memory) CreateRefreshToken(ctx context.Context, token RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, t := range m.refreshTokens {
+		if t.Username == token.Username && t.ExpiresAt.Before(token.CreatedAt) {
+			delete(m.refreshTokens, id)
+		}
+	}
+	m.refreshTokens[token.ID] = token
+	return nil
+}
+
+func (m *Memory) RotateRefreshToken(ctx context.Context, id uuid.UUID, next RefreshToken) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.refreshTokens[id]
+	if !ok || token.RevokedAt != nil || !token.ExpiresAt.After(next.CreatedAt) {
+		return RefreshToken{}, ErrNotFound
+	}
+	if token.UsedAt != nil {
+		m.revokeRefreshTokens(func(t RefreshToken) bool { return t.Family == token.Family }, next.CreatedAt)
+		return RefreshToken{}, ErrTokenReused
+	}
+
+	token.UsedAt = &next.CreatedAt
+	m.refreshTokens[id] = token
+	next.Family = token.Family
+	next.Username = token.Username
+	m.refreshTokens[next.ID] = next
+	return next, nil
+}
+
+func (m *Memory) RevokeRefreshTokenFamily(ctx context.Context, id uuid.UUID, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.refreshTokens[id]
+	if !ok {
+		return nil
+	}
+	m.revokeRefreshTokens(func(t RefreshToken) bool { return t.Family == token.Family }, at)
+	return nil
+}
+
+func (m *Memory) RevokeUserRefreshTokens(ctx context.Context, username string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revokeRefreshTokens(func(t RefreshToken) bool { return t.Username == username }, at)
+	return nil
+}
+
+// revokeRefreshTokens revokes matching tokens, m.mu must be locked
+func (m *Memory) revokeRefreshTokens(match func(RefreshToken) bool, at time.Time) {
+	for id, t := range m.refreshTokens {
+		if match(t) && t.RevokedAt == nil {
+			t.RevokedAt = &at
+			m.refreshTokens[id] = t
+		}
+	}
+}
+
+func (m *Memory) LoginAttempt(ctx context.Context, key string, since time.Time) (LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempt, ok := m.loginAttempts[key]
+	if !ok || attempt.LastFailureAt.Before(since) {
+		return LoginAttempt{Key: key}, nil
+	}
+	return attempt, nil
+}
+
+func (m *Memory) AddLoginFailure(ctx context.Context, key string, at, since time.Time) (LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, v := range m.loginAttempts {
+		if v.LastFailureAt.Before(since) {
+			delete(m.loginAttempts, k)
+		}
+	}
+	attempt, ok := m.loginAttempts[key]
+	if !ok {
+		attempt = LoginAttempt{Key: key}
+	}
+	attempt.Failures++
+	attempt.LastFailureAt = at
+	m.loginAttempts[key] = attempt
+	return attempt, nil
+}
+
+func (m *Memory) ClearLoginFailures(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginAttempts, key)
+	return nil
+}
+
+func (m *Memory) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event.ID = int64(len(m.auditEvents) + 1)
+	m.auditEvents = append(m.auditEvents, event)
+	return nil
+}
+
+func (m *Memory) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Events are appended in order, so newest are at the end
+	var filtered []AuditEvent
+	for i := len(m.auditEvents) - 1; i >= 0; i-- {
+		e := m.auditEvents[i]
+		if (len(filter.Actors) == 0 || arrs.Contains(filter.Actors, e.Actor)) &&
+			(len(filter.Actions) == 0 || arrs.Contains(filter.Actions, e.Action)) &&
+			(len(filter.Clients) == 0 || arrs.Contains(filter.Clients, e.Client)) &&
+			(filter.From == nil || !e.CreatedAt.Before(*filter.From)) &&
+			(filter.To == nil || e.CreatedAt.Before(*filter.To)) {
+			filtered = append(filtered, e)
+		}
+	}
+	return page(filtered, filter.Offset, filter.Limit), len(filtered), nil
+}
+
+func (m *Memory) CreateUser(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[user.Username]; ok {
+		return ErrConflict
+	}
+	for _, client := range user.Clients {
+		if _, ok := m.clients[client]; !ok {
+			return fmt.Errorf("client %s doesn't exist", client)
+		}
+	}
+	m.users[user.Username] = user
+	return nil
+}
+
+func (m *Memory) ListUsers(ctx context.Context, offset, limit int) ([]User, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return page(users, offset, limit), len(users), nil
+}
+
+func (m *Memory) SetUserPassword(ctx context.Context, username, password string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Password = password
+	user.UpdatedAt = at
+	m.users[username] = user
+	return nil
+}
+
+func (m *Memory) SetUserRole(ctx context.Context, username, role string, clients []string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, client := range clients {
+		if _, ok := m.clients[client]; !ok {
+			return fmt.Errorf("client %s doesn't exist", client)
+		}
+	}
+	user.Role = role
+	user.Clients = append([]string{}, clients...)
+	user.UpdatedAt = at
+	m.users[username] = user
+	return nil
+}
+
+func (m *Memory) SetUserDisabled(ctx context.Context, username string, disabled bool, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	if !disabled {
+		user.DisabledAt = nil
+	} else if user.DisabledAt == nil {
+		user.DisabledAt = &at
+	}
+	user.UpdatedAt = at
+	m.users[username] = user
+	return nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[username]; !ok {
+		return ErrNotFound
+	}
+	delete(m.users, username)
+	delete(m.totpSteps, username)
+	delete(m.recoveryCodes, username)
+	for id, token := range m.refreshTokens {
+		if token.Username == username {
+			delete(m.refreshTokens, id)
+		}
+	}
+	return nil
+}
+
+// page returns the part of the slice limited by offset and limit
+func page[T any](s []T, offset, limit int) []T {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(s) {
+		offset = len(s)
+	}
+	end := len(s)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return s[offset:end]
+}
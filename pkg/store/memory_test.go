@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryCreateCashesRollback(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	since := time.Now().Add(-time.Hour)
+
+	existing := Cash{UUID: uuid.New(), Client: "local", Amount: 100}
+	if _, err := m.CreateCashes(ctx, []CashSubmission{{Cash: existing, Idempotency: Idempotency{Key: "kept", Since: since}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch fails on the existing uuid after claiming a new key and replaying a kept one
+	_, err := m.CreateCashes(ctx, []CashSubmission{
+		{Cash: Cash{UUID: uuid.New(), Client: "local", Amount: 200}, Idempotency: Idempotency{Key: "new", Since: since}},
+		{Cash: Cash{UUID: uuid.New(), Client: "local", Amount: 100}, Idempotency: Idempotency{Key: "kept", Since: since}},
+		{Cash: existing},
+	})
+	if err == nil {
+		t.Fatal("batch with an existing uuid is saved")
+	}
+
+	cashes, total, err := m.ListCashes(ctx, CashFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || cashes[0].UUID != existing.UUID {
+		t.Errorf("cashes %+v after the rollback", cashes)
+	}
+	retried := Cash{UUID: uuid.New(), Client: "local", Amount: 200}
+	results, err := m.CreateCashes(ctx, []CashSubmission{{Cash: retried, Idempotency: Idempotency{Key: "new", Since: since}}})
+	if err != nil || results[0].Duplicate || results[0].Cash.UUID != retried.UUID {
+		t.Errorf("key of the rolled back batch is claimed: %+v, %v", results, err)
+	}
+}
+
+func TestMemoryCreateRangeExistingUUID(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	r := Range{UUID: uuid.New(), Client: "local", CreatedAt: time.Now()}
+	if _, _, err := m.CreateRange(ctx, r, Idempotency{}); err != nil {
+		t.Fatal(err)
+	}
+
+	idempotency := Idempotency{Key: "close", Since: time.Now().Add(-time.Hour)}
+	if _, _, err := m.CreateRange(ctx, r, idempotency); err == nil {
+		t.Fatal("range with an existing uuid is saved")
+	}
+	next := Range{UUID: uuid.New(), Client: "local", CreatedAt: time.Now()}
+	summary, duplicate, err := m.CreateRange(ctx, next, idempotency)
+	if err != nil || duplicate || summary.UUID != next.UUID {
+		t.Errorf("key of the failed range is claimed: %s, %t, %v", summary.UUID, duplicate, err)
+	}
+}
+
+func TestMemoryUsers(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddClient("key", "local")
+
+	if err := m.CreateUser(ctx, User{Username: "clerk", Clients: []string{"missing"}}); err == nil {
+		t.Error("user of a missing client is created")
+	}
+	if err := m.CreateUser(ctx, User{Username: "clerk", Clients: []string{"local"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	token := RefreshToken{ID: uuid.New(), Family: uuid.New(), Username: "clerk", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := m.CreateRefreshToken(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteUser(ctx, "clerk"); err != nil {
+		t.Fatal(err)
+	}
+	// A user created again with the name doesn't get the old sessions
+	if err := m.CreateUser(ctx, User{Username: "clerk"}); err != nil {
+		t.Fatal(err)
+	}
+	next := RefreshToken{ID: uuid.New(), Family: token.Family, Username: "clerk", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	if _, err := m.RotateRefreshToken(ctx, token.ID, next); !errors.Is(err, ErrNotFound) {
+		t.Errorf("refresh token of the deleted user rotates: %v", err)
+	}
+}
+
+func TestMemoryLoginAttemptsCleanup(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	now := time.Now()
+
+	if _, err := m.AddLoginFailure(ctx, "ip:stale", now.Add(-2*time.Hour), now.Add(-3*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// A failure of another key deletes the counter without failures since then
+	if _, err := m.AddLoginFailure(ctx, "ip:fresh", now, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.loginAttempts["ip:stale"]; ok {
+		t.Error("stale login attempt counter is kept")
+	}
+	attempt, err := m.AddLoginFailure(ctx, "ip:fresh", now, now.Add(-time.Hour))
+	if err != nil || attempt.Failures != 2 {
+		t.Errorf("fresh counter %+v, %v", attempt, err)
+	}
+}
@@ -0,0 +1,1025 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gocash/pkg/arrs"
+	"gocash/pkg/money"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// querier is implemented by both pool and transaction
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// Postgres is the Store backed by pgx pool
+type Postgres struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgres(pool *pgxpool.Pool) *Postgres {
+	return &Postgres{db: pool}
+}
+
+func (p *Postgres) Close() {
+	p.db.Close()
+}
+
+func (p *Postgres) UseAPIKey(ctx context.Context, key string) (APIKey, error) {
+	prefix, hash := HashAPIKey(key)
+	sqlStatement := `
+	UPDATE api_keys k SET last_used_at = $3
+	FROM clients c
+	WHERE k.prefix = $1 AND k.key_hash = $2 AND k.revoked_at IS NULL AND c.name = k.client AND c.deleted_at IS NULL
+	RETURNING ` + apiKeyColumns
+	apiKey, err := scanAPIKey(p.db.QueryRow(ctx, sqlStatement, prefix, hash, time.Now()))
+	return apiKey, notFound(err)
+}
+
+func (p *Postgres) CreateClient(ctx context.Context, client Client) error {
+	sqlStatement := `
+	INSERT INTO clients (name, detail, created_at, updated_at)
+	VALUES ($1, $2, $3, $4)
+	`
+	_, err := p.db.Exec(ctx, sqlStatement, client.Name, client.Detail, client.CreatedAt, client.UpdatedAt)
+	return conflict(err)
+}
+
+// clientColumns are read by scanClient
+const clientColumns = "name, detail, created_at, updated_at, deleted_at, COALESCE(signing_secret, ''), signature_required, rate_limit, rate_burst, daily_quota"
+
+func scanClient(row pgx.Row) (Client, error) {
+	var client Client
+	err := row.Scan(&client.Name, &client.Detail, &client.CreatedAt, &client.UpdatedAt, &client.DeletedAt, &client.SigningSecret, &client.SignatureRequired,
+		&client.Limits.RateLimit, &client.Limits.RateBurst, &client.Limits.DailyQuota)
+	return client, err
+}
+
+func (p *Postgres) GetClient(ctx context.Context, name string) (Client, error) {
+	client, err := scanClient(p.db.QueryRow(ctx, "SELECT "+clientColumns+" FROM clients WHERE name = $1 AND deleted_at IS NULL", name))
+	return client, notFound(err)
+}
+
+func (p *Postgres) ListClients(ctx context.Context, offset, limit int) ([]Client, int, error) {
+	rows, err := p.db.Query(ctx, "SELECT "+clientColumns+" FROM clients WHERE deleted_at IS NULL ORDER BY name OFFSET $1 LIMIT $2", offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	clients, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Client, error) {
+		return scanClient(row)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := 0
+	if err := p.db.QueryRow(ctx, "SELECT COUNT(*) FROM clients WHERE deleted_at IS NULL").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	return clients, total, nil
+}
+
+func (p *Postgres) UpdateClient(ctx context.Context, client Client) error {
+	tag, err := p.db.Exec(ctx, "UPDATE clients SET detail = $2, updated_at = $3 WHERE name = $1 AND deleted_at IS NULL", client.Name, client.Detail, client.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *Postgres) SetSigningSecret(ctx context.Context, name, secret string, required bool, at time.Time) error {
+	tag, err := p.db.Exec(ctx, "UPDATE clients SET signing_secret = NULLIF($2, ''), signature_required = $3, updated_at = $4 WHERE name = $1 AND deleted_at IS NULL", name, secret, required, at)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *Postgres) SetClientLimits(ctx context.Context, name string, limits ClientLimits, at time.Time) error {
+	sqlStatement := `
+	UPDATE clients SET rate_limit = $2, rate_burst = $3, daily_quota = $4, updated_at = $5
+	WHERE name = $1 AND deleted_at IS NULL
+	`
+	tag, err := p.db.Exec(ctx, sqlStatement, name, limits.RateLimit, limits.RateBurst, limits.DailyQuota, at)
+	return affected(tag, err)
+}
+
+func (p *Postgres) AddAPIKeyUsage(ctx context.Context, usages []APIKeyUsage) error {
+	keys := make([]uuid.UUID, 0, len(usages))
+	clients := make([]string, 0, len(usages))
+	days := make([]time.Time, 0, len(usages))
+	requests := make([]int64, 0, len(usages))
+	for _, usage := range usages {
+		keys = append(keys, usage.APIKey)
+		clients = append(clients, usage.Client)
+		days = append(days, usage.Day)
+		requests = append(requests, usage.Requests)
+	}
+
+	sqlStatement := `
+	INSERT INTO api_key_usage (api_key, client, day, requests)
+	SELECT * FROM unnest($1::uuid[], $2::varchar[], $3::date[], $4::bigint[])
+	ON CONFLICT (api_key, day) DO UPDATE SET requests = api_key_usage.requests + EXCLUDED.requests
+	`
+	_, err := p.db.Exec(ctx, sqlStatement, keys, clients, days, requests)
+	return err
+}
+
+func (p *Postgres) ListAPIKeyUsage(ctx context.Context, client string, from, to time.Time) ([]APIKeyUsage, error) {
+	sqlStatement := `
+	SELECT api_key, client, day, requests FROM api_key_usage
+	WHERE client = $1 AND day BETWEEN $2 AND $3
+	ORDER BY day, api_key
+	`
+	rows, err := p.db.Query(ctx, sqlStatement, client, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (APIKeyUsage, error) {
+		var usage APIKeyUsage
+		err := row.Scan(&usage.APIKey, &usage.Client, &usage.Day, &usage.Requests)
+		return usage, err
+	})
+}
+
+func (p *Postgres) ClaimNonce(ctx context.Context, client, nonce string, expiresAt time.Time) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM request_nonces WHERE client = $1 AND expires_at < $2", client, time.Now())
+		if err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, "INSERT INTO request_nonces (client, nonce, expires_at) VALUES ($1, $2, $3) ON CONFLICT (client, nonce) DO NOTHING", client, nonce, expiresAt)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrConflict
+		}
+		return nil
+	})
+}
+
+func (p *Postgres) DeleteClient(ctx context.Context, name string, at time.Time) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE clients SET deleted_at = $2, updated_at = $2 WHERE name = $1 AND deleted_at IS NULL", name, at)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.Exec(ctx, "UPDATE api_keys SET revoked_at = $2 WHERE client = $1 AND revoked_at IS NULL", name, at)
+		return err
+	})
+}
+
+// apiKeyColumns are read by scanAPIKey
+const apiKeyColumns = "k.uuid, k.client, k.prefix, k.key_hash, k.label, k.created_at, k.revoked_at, k.last_used_at"
+
+func scanAPIKey(row pgx.Row) (APIKey, error) {
+	var key APIKey
+	err := row.Scan(&key.UUID, &key.Client, &key.Prefix, &key.KeyHash, &key.Label, &key.CreatedAt, &key.RevokedAt, &key.LastUsedAt)
+	return key, err
+}
+
+func (p *Postgres) CreateAPIKey(ctx context.Context, key APIKey) error {
+	sqlStatement := `
+	INSERT INTO api_keys (uuid, client, prefix, key_hash, label, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := p.db.Exec(ctx, sqlStatement, key.UUID, key.Client, key.Prefix, key.KeyHash, key.Label, key.CreatedAt)
+	return conflict(err)
+}
+
+func (p *Postgres) ListAPIKeys(ctx context.Context, client string) ([]APIKey, error) {
+	rows, err := p.db.Query(ctx, "SELECT "+apiKeyColumns+" FROM api_keys k WHERE k.client = $1 ORDER BY k.created_at DESC", client)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (APIKey, error) {
+		return scanAPIKey(row)
+	})
+}
+
+func (p *Postgres) RevokeAPIKey(ctx context.Context, client string, id uuid.UUID, at time.Time) (APIKey, error) {
+	sqlStatement := `
+	UPDATE api_keys k SET revoked_at = COALESCE(k.revoked_at, $3)
+	WHERE k.uuid = $1 AND k.client = $2
+	RETURNING ` + apiKeyColumns
+	key, err := scanAPIKey(p.db.QueryRow(ctx, sqlStatement, id, client, at))
+	return key, notFound(err)
+}
+
+func (p *Postgres) CreateCash(ctx context.Context, cash Cash, idempotency Idempotency) (Cash, bool, error) {
+	results, err := p.CreateCashes(ctx, []CashSubmission{{Cash: cash, Idempotency: idempotency}})
+	if err != nil {
+		return Cash{}, false, err
+	}
+	return results[0].Cash, results[0].Duplicate, nil
+}
+
+func (p *Postgres) CreateCashes(ctx context.Context, submissions []CashSubmission) ([]CashResult, error) {
+	results := make([]CashResult, 0, len(submissions))
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		for _, submission := range submissions {
+			cash := submission.Cash
+			if submission.Idempotency.Key != "" {
+				originalUUID, claimed, err := claimIdempotencyKey(ctx, tx, cash.Client, "cash", submission.Idempotency, cash.UUID)
+				if err != nil {
+					return err
+				}
+				if !claimed {
+					original, err := getCash(ctx, tx, originalUUID)
+					if err != nil {
+						return err
+					}
+					results = append(results, CashResult{Cash: original, Duplicate: true})
+					continue
+				}
+			}
+
+			sqlStatement := `
+			INSERT INTO cashes (uuid, created_at, updated_at, inserted_at, clock_skewed, client, contact, amount, currency, detail, note)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			`
+			_, err := tx.Exec(ctx, sqlStatement, cash.UUID, cash.CreatedAt, cash.UpdatedAt, cash.InsertedAt, cash.ClockSkewed, cash.Client, cash.Contact, cash.Amount, cash.Currency, cash.Detail, cash.Note)
+			if err != nil {
+				return err
+			}
+			results = append(results, CashResult{Cash: cash})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (p *Postgres) GetCash(ctx context.Context, id uuid.UUID) (Cash, error) {
+	return getCash(ctx, p.db, id)
+}
+
+// cashColumns are read by scanCash
+const cashColumns = "uuid, created_at, updated_at, inserted_at, clock_skewed, client, contact, amount, currency, detail, note, range_uuid, voided_at, voided_by, void_reason"
+
+func scanCash(row pgx.Row) (Cash, error) {
+	var cash Cash
+	var voidedAt *time.Time
+	var voidedBy, voidReason *string
+	err := row.Scan(&cash.UUID, &cash.CreatedAt, &cash.UpdatedAt, &cash.InsertedAt, &cash.ClockSkewed, &cash.Client, &cash.Contact, &cash.Amount, &cash.Currency, &cash.Detail, &cash.Note, &cash.RangeUUID, &voidedAt, &voidedBy, &voidReason)
+	if err != nil {
+		return Cash{}, err
+	}
+	if voidedAt != nil {
+		cash.Void = &Void{At: *voidedAt}
+		if voidedBy != nil {
+			cash.Void.By = *voidedBy
+		}
+		if voidReason != nil {
+			cash.Void.Reason = *voidReason
+		}
+	}
+	return cash, nil
+}
+
+func getCash(ctx context.Context, q querier, id uuid.UUID) (Cash, error) {
+	cash, err := scanCash(q.QueryRow(ctx, "SELECT "+cashColumns+" FROM cashes WHERE uuid = $1", id))
+	return cash, notFound(err)
+}
+
+func (p *Postgres) VoidCash(ctx context.Context, id uuid.UUID, void Void) (Cash, error) {
+	// Conditions are checked again after a concurrent range releases the row,
+	// so a cash is never voided after it has been counted
+	sqlStatement := `
+	UPDATE cashes SET voided_at = $2, voided_by = $3, void_reason = $4, updated_at = $2
+	WHERE uuid = $1 AND voided_at IS NULL AND range_uuid IS NULL
+	RETURNING ` + cashColumns
+	cash, err := scanCash(p.db.QueryRow(ctx, sqlStatement, id, void.At, void.By, void.Reason))
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return cash, err
+	}
+
+	// Find out why the cash hasn't been voided
+	cash, err = getCash(ctx, p.db, id)
+	if err != nil {
+		return Cash{}, err
+	}
+	if cash.Void != nil {
+		return Cash{}, ErrAlreadyVoided
+	}
+	return Cash{}, ErrSettled
+}
+
+func (p *Postgres) ListCashes(ctx context.Context, filter CashFilter) ([]Cash, int, error) {
+	// Sort fields to have stable placeholders
+	fields := make([]string, 0, len(filter.Patterns))
+	for k := range filter.Patterns {
+		if !arrs.Contains(CashFilterFields, k) {
+			return nil, 0, fmt.Errorf("unknown cash filter field %s", k)
+		}
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+
+	var values []interface{}
+	var queries []string
+	for _, k := range fields {
+		values = append(values, filter.Patterns[k])
+		queries = append(queries, fmt.Sprintf("%s::text ~* $%d", k, len(values)))
+	}
+	if len(filter.Amounts) > 0 {
+		values = append(values, amountsToInt64(filter.Amounts))
+		queries = append(queries, fmt.Sprintf("amount = ANY($%d)", len(values)))
+	}
+	if len(filter.Currencies) > 0 {
+		values = append(values, filter.Currencies)
+		queries = append(queries, fmt.Sprintf("currency = ANY($%d)", len(values)))
+	}
+	if len(filter.Clients) > 0 {
+		values = append(values, filter.Clients)
+		queries = append(queries, fmt.Sprintf("client = ANY($%d)", len(values)))
+	}
+	if !filter.IncludeVoided {
+		queries = append(queries, "voided_at IS NULL")
+	}
+	clockColumn := "created_at"
+	if filter.Clock == ClockDevice {
+		clockColumn = "COALESCE(inserted_at, created_at)"
+	}
+	if filter.From != nil {
+		values = append(values, *filter.From)
+		queries = append(queries, fmt.Sprintf("%s >= $%d", clockColumn, len(values)))
+	}
+	if filter.To != nil {
+		values = append(values, *filter.To)
+		queries = append(queries, fmt.Sprintf("%s < $%d", clockColumn, len(values)))
+	}
+
+	sqlFilters := ""
+	if len(queries) > 0 {
+		sqlFilters = " WHERE " + strings.Join(queries, " AND ")
+	}
+
+	sqlStatement := "SELECT " + cashColumns + " FROM cashes" + sqlFilters
+	sqlStatement += fmt.Sprintf(" ORDER BY %s DESC OFFSET $%d LIMIT $%d", clockColumn, len(values)+1, len(values)+2)
+	rows, err := p.db.Query(ctx, sqlStatement, append(values, filter.Offset, filter.Limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	cashes := make([]Cash, 0)
+	for rows.Next() {
+		cash, err := scanCash(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		cashes = append(cashes, cash)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	total := 0
+	err = p.db.QueryRow(ctx, "SELECT COUNT(*) FROM cashes"+sqlFilters, values...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return cashes, total, nil
+}
+
+// rangeSnapshotStatements assign open cashes of a client ($2) to a range ($1) and save its totals.
+// Voided cashes are closed by the range too but they aren't counted
+var rangeSnapshotStatements = []string{
+	`UPDATE cashes SET range_uuid = $1 WHERE client = $2 AND range_uuid IS NULL`,
+	`
+	INSERT INTO range_totals (range_uuid, currency, total_amount)
+	SELECT $1::uuid, currency, SUM(amount)
+	FROM cashes
+	WHERE range_uuid = $1 AND voided_at IS NULL
+	GROUP BY currency
+	`,
+	`
+	INSERT INTO range_denominations (range_uuid, currency, value, count, total_amount)
+	SELECT t.range_uuid, t.currency, d.value, COUNT(c.amount), COALESCE(SUM(c.amount), 0)
+	FROM range_totals t
+	JOIN denominations d ON d.currency = t.currency AND (
+		d.client = $2 OR
+		d.client IS NULL AND NOT EXISTS (SELECT 1 FROM denominations o WHERE o.client = $2 AND o.currency = t.currency)
+	)
+	LEFT JOIN cashes c ON c.range_uuid = t.range_uuid AND c.currency = t.currency AND c.amount = d.value AND c.voided_at IS NULL
+	WHERE t.range_uuid = $1
+	GROUP BY t.range_uuid, t.currency, d.value
+	`,
+}
+
+// rangeSummariesQuery joins ranges of the page CTE with their snapshots,
+// so it must be prefixed with the page CTE
+const rangeSummariesQuery = `
+SELECT p.uuid, p.created_at, p.updated_at, p.client, p.detail, p.note,
+	t.currency, t.total_amount, d.value, d.count, d.total_amount
+FROM page p
+LEFT JOIN range_totals t ON t.range_uuid = p.uuid
+LEFT JOIN range_denominations d ON d.range_uuid = t.range_uuid AND d.currency = t.currency
+ORDER BY p.created_at DESC, p.uuid, t.currency, d.value
+`
+
+func (p *Postgres) CreateRange(ctx context.Context, r Range, idempotency Idempotency) (RangeSummary, bool, error) {
+	var summary RangeSummary
+	duplicate := false
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// Only one range of the client can be closed at a time
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", r.Client); err != nil {
+			return err
+		}
+
+		if idempotency.Key != "" {
+			originalUUID, claimed, err := claimIdempotencyKey(ctx, tx, r.Client, "range", idempotency, r.UUID)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				duplicate = true
+				summary, err = getRange(ctx, tx, originalUUID)
+				return err
+			}
+		}
+
+		sqlStatement := `
+		INSERT INTO ranges (uuid, created_at, updated_at, client, detail, note)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		`
+		_, err := tx.Exec(ctx, sqlStatement, r.UUID, r.CreatedAt, r.UpdatedAt, r.Client, r.Detail, r.Note)
+		if err != nil {
+			return err
+		}
+
+		// Close open cashes and save totals of the range
+		for _, sqlStatement := range rangeSnapshotStatements {
+			if _, err := tx.Exec(ctx, sqlStatement, r.UUID, r.Client); err != nil {
+				return err
+			}
+		}
+
+		summary, err = getRange(ctx, tx, r.UUID)
+		return err
+	})
+	return summary, duplicate, err
+}
+
+func getRange(ctx context.Context, q querier, id uuid.UUID) (RangeSummary, error) {
+	rows, err := q.Query(ctx, "WITH page AS (SELECT * FROM ranges WHERE uuid = $1)"+rangeSummariesQuery, id)
+	if err != nil {
+		return RangeSummary{}, err
+	}
+	summaries, err := collectRangeSummaries(rows)
+	if err != nil {
+		return RangeSummary{}, err
+	}
+	if len(summaries) != 1 {
+		return RangeSummary{}, ErrNotFound
+	}
+	return summaries[0], nil
+}
+
+func (p *Postgres) ListRanges(ctx context.Context, filter RangeFilter) ([]RangeSummary, int, error) {
+	var values []interface{}
+	sqlFilters := ""
+	if len(filter.Clients) > 0 {
+		values = append(values, filter.Clients)
+		sqlFilters = " WHERE client = ANY($1)"
+	}
+
+	pageStatement := fmt.Sprintf("WITH page AS (SELECT * FROM ranges%s ORDER BY created_at DESC OFFSET $%d LIMIT $%d)", sqlFilters, len(values)+1, len(values)+2)
+	rows, err := p.db.Query(ctx, pageStatement+rangeSummariesQuery, append(values, filter.Offset, filter.Limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	summaries, err := collectRangeSummaries(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Find total count of ranges
+	total := 0
+	if err := p.db.QueryRow(ctx, "SELECT COUNT(*) FROM ranges"+sqlFilters, values...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	return summaries, total, nil
+}
+
+// collectRangeSummaries reads rows of rangeSummariesQuery
+func collectRangeSummaries(rows pgx.Rows) ([]RangeSummary, error) {
+	defer rows.Close()
+
+	summaries := make([]RangeSummary, 0)
+	for rows.Next() {
+		var r Range
+		var currency *string
+		var totalAmount, value, denominationTotal *money.Amount
+		var count *uint
+		err := rows.Scan(&r.UUID, &r.CreatedAt, &r.UpdatedAt, &r.Client, &r.Detail, &r.Note, &currency, &totalAmount, &value, &count, &denominationTotal)
+		if err != nil {
+			return nil, err
+		}
+
+		// Rows are ordered by range and currency, so a new range or currency starts a new summary
+		if len(summaries) == 0 || summaries[len(summaries)-1].UUID != r.UUID {
+			summaries = append(summaries, RangeSummary{Range: r, Totals: []CurrencySummary{}})
+		}
+		summary := &summaries[len(summaries)-1]
+		if currency == nil {
+			continue
+		}
+		if len(summary.Totals) == 0 || summary.Totals[len(summary.Totals)-1].Currency != *currency {
+			summary.Totals = append(summary.Totals, CurrencySummary{
+				Currency:      *currency,
+				TotalAmount:   *totalAmount,
+				Denominations: []DenominationSummary{},
+			})
+		}
+		if value == nil {
+			continue
+		}
+		currencySummary := &summary.Totals[len(summary.Totals)-1]
+		currencySummary.Denominations = append(currencySummary.Denominations, DenominationSummary{
+			Value:       *value,
+			Count:       *count,
+			TotalAmount: *denominationTotal,
+		})
+	}
+	return summaries, rows.Err()
+}
+
+func (p *Postgres) Denominations(ctx context.Context, client, currency string) ([]money.Amount, error) {
+	sqlStatement := `
+	SELECT value FROM denominations
+	WHERE currency = $2 AND (
+		client = $1 OR
+		client IS NULL AND NOT EXISTS (SELECT 1 FROM denominations WHERE client = $1 AND currency = $2)
+	)
+	ORDER BY value
+	`
+	rows, err := p.db.Query(ctx, sqlStatement, client, currency)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[money.Amount])
+}
+
+func (p *Postgres) SetDenominations(ctx context.Context, client, currency string, values []money.Amount) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM denominations WHERE client IS NOT DISTINCT FROM NULLIF($1, '') AND currency = $2", client, currency)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO denominations (client, currency, value) SELECT NULLIF($1, ''), $2, unnest($3::bigint[])", client, currency, amountsToInt64(values))
+		return err
+	})
+}
+
+// userColumns are read by scanUser
+const userColumns = `username, password, role, created_at, updated_at, disabled_at,
+	ARRAY(SELECT client FROM user_clients c WHERE c.username = users.username ORDER BY client),
+	COALESCE(totp_secret, ''), totp_enabled_at`
+
+func scanUser(row pgx.Row) (User, error) {
+	var user User
+	err := row.Scan(&user.Username, &user.Password, &user.Role, &user.CreatedAt, &user.UpdatedAt, &user.DisabledAt, &user.Clients,
+		&user.TOTPSecret, &user.TOTPEnabledAt)
+	return user, err
+}
+
+func (p *Postgres) UserByUsername(ctx context.Context, username string) (User, error) {
+	user, err := scanUser(p.db.QueryRow(ctx, "SELECT "+userColumns+" FROM users WHERE username = $1", username))
+	return user, notFound(err)
+}
+
+func (p *Postgres) CreateUser(ctx context.Context, user User) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		sqlStatement := `
+		INSERT INTO users (username, password, role, created_at, updated_at, disabled_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		`
+		_, err := tx.Exec(ctx, sqlStatement, user.Username, user.Password, user.Role, user.CreatedAt, user.UpdatedAt, user.DisabledAt)
+		if err != nil {
+			return conflict(err)
+		}
+		return setUserClients(ctx, tx, user.Username, user.Clients)
+	})
+}
+
+func (p *Postgres) SetUserRole(ctx context.Context, username, role string, clients []string, at time.Time) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE users SET role = $2, updated_at = $3 WHERE username = $1", username, role, at)
+		if err := affected(tag, err); err != nil {
+			return err
+		}
+		return setUserClients(ctx, tx, username, clients)
+	})
+}
+
+// setUserClients replaces clients assigned to the user
+func setUserClients(ctx context.Context, tx pgx.Tx, username string, clients []string) error {
+	_, err := tx.Exec(ctx, "DELETE FROM user_clients WHERE username = $1", username)
+	if err != nil {
+		return err
+	}
+	if len(clients) == 0 {
+		return nil
+	}
+	_, err = tx.Exec(ctx, "INSERT INTO user_clients (username, client) SELECT $1, unnest($2::varchar[])", username, clients)
+	return err
+}
+
+func (p *Postgres) ListUsers(ctx context.Context, offset, limit int) ([]User, int, error) {
+	rows, err := p.db.Query(ctx, "SELECT "+userColumns+" FROM users ORDER BY username OFFSET $1 LIMIT $2", offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	users, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (User, error) {
+		return scanUser(row)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := 0
+	if err := p.db.QueryRow(ctx, "SELECT COUNT(*) FROM users").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func (p *Postgres) SetUserPassword(ctx context.Context, username, password string, at time.Time) error {
+	tag, err := p.db.Exec(ctx, "UPDATE users SET password = $2, updated_at = $3 WHERE username = $1", username, password, at)
+	return affected(tag, err)
+}
+
+func (p *Postgres) SetUserDisabled(ctx context.Context, username string, disabled bool, at time.Time) error {
+	sqlStatement := `
+	UPDATE users SET updated_at = $3,
+		disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, $3) END
+	WHERE username = $1
+	`
+	tag, err := p.db.Exec(ctx, sqlStatement, username, disabled, at)
+	return affected(tag, err)
+}
+
+func (p *Postgres) DeleteUser(ctx context.Context, username string) error {
+	tag, err := p.db.Exec(ctx, "DELETE FROM users WHERE username = $1", username)
+	return affected(tag, err)
+}
+
+func (p *Postgres) SetTOTPSecret(ctx context.Context, username, secret string, at time.Time) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		sqlStatement := `
+		UPDATE users SET totp_secret = NULLIF($2, ''), totp_enabled_at = NULL, totp_last_step = 0, updated_at = $3
+		WHERE username = $1
+		`
+		tag, err := tx.Exec(ctx, sqlStatement, username, secret, at)
+		if err := affected(tag, err); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM recovery_codes WHERE username = $1", username)
+		return err
+	})
+}
+
+func (p *Postgres) EnableTOTP(ctx context.Context, username string, step int64, recoveryCodes []string, at time.Time) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		sqlStatement := `
+		UPDATE users SET totp_enabled_at = $3, totp_last_step = $2, updated_at = $3
+		WHERE username = $1 AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL
+		`
+		tag, err := tx.Exec(ctx, sqlStatement, username, step, at)
+		if err := affected(tag, err); err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(ctx, tx, username, recoveryCodes)
+	})
+}
+
+func (p *Postgres) UseTOTPStep(ctx context.Context, username string, step int64) error {
+	tag, err := p.db.Exec(ctx, "UPDATE users SET totp_last_step = $2 WHERE username = $1 AND totp_last_step < $2", username, step)
+	if err := affected(tag, err); errors.Is(err, ErrNotFound) {
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *Postgres) UseChallenge(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "DELETE FROM used_challenges WHERE expires_at < $1", time.Now()); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, "INSERT INTO used_challenges (id, expires_at) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING", id, expiresAt)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrConflict
+		}
+		return nil
+	})
+}
+
+func (p *Postgres) SetRecoveryCodes(ctx context.Context, username string, recoveryCodes []string) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		return replaceRecoveryCodes(ctx, tx, username, recoveryCodes)
+	})
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, username string, recoveryCodes []string) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM recovery_codes WHERE username = $1", username); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "INSERT INTO recovery_codes (username, code_hash) SELECT $1, unnest($2::varchar[])", username, recoveryCodes)
+	return err
+}
+
+func (p *Postgres) UseRecoveryCode(ctx context.Context, username, recoveryCode string, at time.Time) error {
+	tag, err := p.db.Exec(ctx, "UPDATE recovery_codes SET used_at = $3 WHERE username = $1 AND code_hash = $2 AND used_at IS NULL", username, recoveryCode, at)
+	return affected(tag, err)
+}
+
+func (p *Postgres) TwoFactorRoles(ctx context.Context) ([]string, error) {
+	rows, err := p.db.Query(ctx, "SELECT role FROM two_factor_roles ORDER BY role")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (p *Postgres) SetTwoFactorRoles(ctx context.Context, roles []string) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "DELETE FROM two_factor_roles"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, "INSERT INTO two_factor_roles (role) SELECT unnest($1::varchar[])", roles)
+		return err
+	})
+}
+
+func (p *Postgres) CreateRefreshToken(ctx context.Context, token RefreshToken) error {
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// Expired tokens of the user aren't needed anymore
+		_, err := tx.Exec(ctx, "DELETE FROM refresh_tokens WHERE username = $1 AND expires_at < $2", token.Username, token.CreatedAt)
+		if err != nil {
+			return err
+		}
+		return insertRefreshToken(ctx, tx, token)
+	})
+}
+
+func insertRefreshToken(ctx context.Context, tx pgx.Tx, token RefreshToken) error {
+	sqlStatement := `
+	INSERT INTO refresh_tokens (id, family, username, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := tx.Exec(ctx, sqlStatement, token.ID, token.Family, token.Username, token.CreatedAt, token.ExpiresAt)
+	return err
+}
+
+func (p *Postgres) RotateRefreshToken(ctx context.Context, id uuid.UUID, next RefreshToken) (RefreshToken, error) {
+	reused := false
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		var token RefreshToken
+		err := tx.QueryRow(ctx, "SELECT family, username, expires_at, used_at, revoked_at FROM refresh_tokens WHERE id = $1 FOR UPDATE", id).Scan(&token.Family, &token.Username, &token.ExpiresAt, &token.UsedAt, &token.RevokedAt)
+		if err != nil {
+			return notFound(err)
+		}
+		if token.RevokedAt != nil || !token.ExpiresAt.After(next.CreatedAt) {
+			return ErrNotFound
+		}
+		if token.UsedAt != nil {
+			// The revoke is committed, the error is returned after the transaction
+			reused = true
+			_, err := tx.Exec(ctx, "UPDATE refresh_tokens SET revoked_at = $2 WHERE family = $1 AND revoked_at IS NULL", token.Family, next.CreatedAt)
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE refresh_tokens SET used_at = $2 WHERE id = $1", id, next.CreatedAt); err != nil {
+			return err
+		}
+		next.Family = token.Family
+		next.Username = token.Username
+		return insertRefreshToken(ctx, tx, next)
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if reused {
+		return RefreshToken{}, ErrTokenReused
+	}
+	return next, nil
+}
+
+func (p *Postgres) RevokeRefreshTokenFamily(ctx context.Context, id uuid.UUID, at time.Time) error {
+	sqlStatement := `
+	UPDATE refresh_tokens SET revoked_at = $2
+	WHERE family = (SELECT family FROM refresh_tokens WHERE id = $1) AND revoked_at IS NULL
+	`
+	_, err := p.db.Exec(ctx, sqlStatement, id, at)
+	return err
+}
+
+func (p *Postgres) RevokeUserRefreshTokens(ctx context.Context, username string, at time.Time) error {
+	_, err := p.db.Exec(ctx, "UPDATE refresh_tokens SET revoked_at = $2 WHERE username = $1 AND revoked_at IS NULL", username, at)
+	return err
+}
+
+func (p *Postgres) LoginAttempt(ctx context.Context, key string, since time.Time) (LoginAttempt, error) {
+	attempt := LoginAttempt{Key: key}
+	err := p.db.QueryRow(ctx, "SELECT failures, last_failure_at FROM login_attempts WHERE key = $1 AND last_failure_at >= $2", key, since).Scan(&attempt.Failures, &attempt.LastFailureAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return attempt, nil
+	}
+	return attempt, err
+}
+
+func (p *Postgres) AddLoginFailure(ctx context.Context, key string, at, since time.Time) (LoginAttempt, error) {
+	attempt := LoginAttempt{Key: key}
+	err := pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		// Counters of other keys stop mattering after the window, so they don't pile up
+		if _, err := tx.Exec(ctx, "DELETE FROM login_attempts WHERE last_failure_at < $1 AND key <> $2", since, key); err != nil {
+			return err
+		}
+		sqlStatement := `
+		INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = $2
+		RETURNING failures, last_failure_at
+		`
+		return tx.QueryRow(ctx, sqlStatement, key, at, since).Scan(&attempt.Failures, &attempt.LastFailureAt)
+	})
+	return attempt, err
+}
+
+func (p *Postgres) ClearLoginFailures(ctx context.Context, key string) error {
+	_, err := p.db.Exec(ctx, "DELETE FROM login_attempts WHERE key = $1", key)
+	return err
+}
+
+func (p *Postgres) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	sqlStatement := `
+	INSERT INTO audit_events (created_at, action, actor, client, ip, user_agent, resource_uuid, before, after)
+	VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9)
+	`
+	_, err := p.db.Exec(ctx, sqlStatement, event.CreatedAt, event.Action, event.Actor, event.Client, event.IP, event.UserAgent, event.ResourceUUID, nullJSON(event.Before), nullJSON(event.After))
+	return err
+}
+
+func (p *Postgres) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, int, error) {
+	var values []interface{}
+	var queries []string
+	if len(filter.Actors) > 0 {
+		values = append(values, filter.Actors)
+		queries = append(queries, fmt.Sprintf("actor = ANY($%d)", len(values)))
+	}
+	if len(filter.Actions) > 0 {
+		values = append(values, filter.Actions)
+		queries = append(queries, fmt.Sprintf("action = ANY($%d)", len(values)))
+	}
+	if len(filter.Clients) > 0 {
+		values = append(values, filter.Clients)
+		queries = append(queries, fmt.Sprintf("client = ANY($%d)", len(values)))
+	}
+	if filter.From != nil {
+		values = append(values, *filter.From)
+		queries = append(queries, fmt.Sprintf("created_at >= $%d", len(values)))
+	}
+	if filter.To != nil {
+		values = append(values, *filter.To)
+		queries = append(queries, fmt.Sprintf("created_at < $%d", len(values)))
+	}
+
+	sqlFilters := ""
+	if len(queries) > 0 {
+		sqlFilters = " WHERE " + strings.Join(queries, " AND ")
+	}
+
+	sqlStatement := "SELECT id, created_at, action, actor, COALESCE(client, ''), ip, user_agent, resource_uuid, before, after FROM audit_events" + sqlFilters
+	sqlStatement += fmt.Sprintf(" ORDER BY created_at DESC, id DESC OFFSET $%d LIMIT $%d", len(values)+1, len(values)+2)
+	rows, err := p.db.Query(ctx, sqlStatement, append(values, filter.Offset, filter.Limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	events := make([]AuditEvent, 0)
+	for rows.Next() {
+		var event AuditEvent
+		err := rows.Scan(&event.ID, &event.CreatedAt, &event.Action, &event.Actor, &event.Client, &event.IP, &event.UserAgent, &event.ResourceUUID, &event.Before, &event.After)
+		if err != nil {
+			return nil, 0, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	total := 0
+	err = p.db.QueryRow(ctx, "SELECT COUNT(*) FROM audit_events"+sqlFilters, values...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+// nullJSON stores empty JSON as NULL
+func nullJSON(data []byte) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
+
+// claimIdempotencyKey saves the key of the client's resource for the given uuid.
+// If the key is already used it returns uuid of the original resource and false.
+// Expired keys of the client are removed first, so they can be claimed again
+func claimIdempotencyKey(ctx context.Context, tx pgx.Tx, client, resource string, idempotency Idempotency, id uuid.UUID) (uuid.UUID, bool, error) {
+	_, err := tx.Exec(ctx, "DELETE FROM idempotency_keys WHERE client = $1 AND created_at < $2", client, idempotency.Since)
+	if err != nil {
+		return uuid.UUID{}, false, err
+	}
+
+	// Concurrent insert of the same key waits until the first one commits or rolls back
+	sqlStatement := `
+	INSERT INTO idempotency_keys (client, resource, key, resource_uuid, created_at)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (client, resource, key) DO NOTHING
+	`
+	tag, err := tx.Exec(ctx, sqlStatement, client, resource, idempotency.Key, id, time.Now())
+	if err != nil {
+		return uuid.UUID{}, false, err
+	}
+	if tag.RowsAffected() == 1 {
+		return id, true, nil
+	}
+
+	var originalUUID uuid.UUID
+	err = tx.QueryRow(ctx, "SELECT resource_uuid FROM idempotency_keys WHERE client = $1 AND resource = $2 AND key = $3", client, resource, idempotency.Key).Scan(&originalUUID)
+	return originalUUID, false, err
+}
+
+func amountsToInt64(amounts []money.Amount) []int64 {
+	values := make([]int64, 0, len(amounts))
+	for _, amount := range amounts {
+		values = append(values, int64(amount))
+	}
+	return values
+}
+
+// affected returns ErrNotFound if the statement hasn't changed any row
+func affected(tag pgconn.CommandTag, err error) error {
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// conflict converts unique violation to ErrConflict
+func conflict(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrConflict
+	}
+	return err
+}
+
+// notFound converts pgx.ErrNoRows to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocash/pkg/db"
+	"gocash/pkg/money"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testPostgres connects to TEST_DATABASE_URL and migrates it, the data of the database is deleted.
+// Tests are skipped without it
+func testPostgres(tb testing.TB) *Postgres {
+	tb.Helper()
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		tb.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, databaseURL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(pool.Close)
+	if _, err := db.MigrateUp(ctx, pool); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, "TRUNCATE ranges, cashes, denominations, clients CASCADE"); err != nil {
+		tb.Fatal(err)
+	}
+	return NewPostgres(pool)
+}
+
+// seedRanges adds rangesPerClient ranges of clients a and b with cashesPerRange cashes each.
+// Every third range of client b is empty, client a has its own TMT denominations and
+// b uses the global ones, USD has 1.00 only, so some denominations don't have any cash
+func seedRanges(tb testing.TB, p *Postgres, rangesPerClient, cashesPerRange int) {
+	tb.Helper()
+	ctx := context.Background()
+
+	denominations := map[[2]string][]money.Amount{
+		{"", "TMT"}:  {100, 500, 1000, 2000, 5000, 10000},
+		{"a", "TMT"}: {100, 500, 700},
+		{"", "USD"}:  {100},
+	}
+	for key, values := range denominations {
+		if err := p.SetDenominations(ctx, key[0], key[1], values); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	amounts := []money.Amount{100, 500, 1000, 2000, 250}
+	currencies := []string{"TMT", "TMT", "USD"}
+	at := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, client := range []string{"a", "b"} {
+		if err := p.CreateClient(ctx, Client{Name: client, CreatedAt: at, UpdatedAt: at}); err != nil {
+			tb.Fatal(err)
+		}
+		for r := 0; r < rangesPerClient; r++ {
+			if client != "b" || r%3 != 0 {
+				submissions := make([]CashSubmission, 0, cashesPerRange)
+				for c := 0; c < cashesPerRange; c++ {
+					at = at.Add(time.Second)
+					submissions = append(submissions, CashSubmission{Cash: Cash{
+						UUID:      uuid.New(),
+						CreatedAt: at,
+						UpdatedAt: at,
+						Client:    client,
+						Contact:   "contact",
+						Amount:    amounts[(r+c)%len(amounts)],
+						Currency:  currencies[c%len(currencies)],
+					}})
+				}
+				if _, err := p.CreateCashes(ctx, submissions); err != nil {
+					tb.Fatal(err)
+				}
+			}
+
+			at = at.Add(time.Second)
+			_, _, err := p.CreateRange(ctx, Range{UUID: uuid.New(), CreatedAt: at, UpdatedAt: at, Client: client}, Idempotency{})
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+// firstRangeTime is the start of the first range of a client, as in the range snapshots migration
+var firstRangeTime = time.Date(2001, 12, 28, 0, 0, 0, 0, time.UTC)
+
+// listRangesPerRange is ListRanges before the range snapshots: a query for the page,
+// then the previous range, the totals and the denominations of every range
+func listRangesPerRange(ctx context.Context, p *Postgres, offset, limit int) ([]RangeSummary, error) {
+	rows, err := p.db.Query(ctx, `SELECT r.uuid, r.created_at, r.updated_at, r.client, r.detail, r.note FROM ranges r ORDER BY r.created_at DESC OFFSET $1 LIMIT $2`, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Range, error) {
+		var r Range
+		err := row.Scan(&r.UUID, &r.CreatedAt, &r.UpdatedAt, &r.Client, &r.Detail, &r.Note)
+		return r, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]RangeSummary, 0, len(ranges))
+	for _, r := range ranges {
+		summary := RangeSummary{Range: r}
+
+		from := firstRangeTime
+		err := p.db.QueryRow(ctx, "SELECT created_at FROM ranges WHERE created_at < $1 AND client = $2 ORDER BY created_at DESC LIMIT 1", r.CreatedAt, r.Client).Scan(&from)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+
+		rows, err := p.db.Query(ctx, "SELECT currency, SUM(amount)::bigint FROM cashes WHERE created_at >= $1 AND created_at <= $2 AND client = $3 GROUP BY currency ORDER BY currency", from, r.CreatedAt, r.Client)
+		if err != nil {
+			return nil, err
+		}
+		summary.Totals, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (CurrencySummary, error) {
+			var total CurrencySummary
+			err := row.Scan(&total.Currency, &total.TotalAmount)
+			return total, err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range summary.Totals {
+			total := &summary.Totals[i]
+			values, err := p.Denominations(ctx, r.Client, total.Currency)
+			if err != nil {
+				return nil, err
+			}
+			sqlStatement := `
+			SELECT d.value, COALESCE(SUM(c.amount), 0)::bigint, COUNT(c.amount)
+			FROM unnest($1::bigint[]) d(value)
+			LEFT JOIN cashes c ON c.amount = d.value AND c.created_at >= $2 AND c.created_at <= $3 AND c.client = $4 AND c.currency = $5
+			GROUP BY d.value
+			ORDER BY d.value
+			`
+			rows, err := p.db.Query(ctx, sqlStatement, amountsToInt64(values), from, r.CreatedAt, r.Client, total.Currency)
+			if err != nil {
+				return nil, err
+			}
+			total.Denominations, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (DenominationSummary, error) {
+				var denomination DenominationSummary
+				err := row.Scan(&denomination.Value, &denomination.TotalAmount, &denomination.Count)
+				return denomination, err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+func TestListRangesMatchesPerRangeQueries(t *testing.T) {
+	p := testPostgres(t)
+	seedRanges(t, p, 6, 7)
+	ctx := context.Background()
+
+	for _, page := range []struct{ offset, limit int }{{0, 5}, {3, 4}, {0, 100}} {
+		expected, err := listRangesPerRange(ctx, p, page.offset, page.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, _, err := p.ListRanges(ctx, RangeFilter{Offset: page.offset, Limit: page.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedJSON, _ := json.Marshal(expected)
+		actualJSON, _ := json.Marshal(actual)
+		if !bytes.Equal(expectedJSON, actualJSON) {
+			t.Errorf("offset %d limit %d:\nper range %s\nlist      %s", page.offset, page.limit, expectedJSON, actualJSON)
+		}
+	}
+
+	// The seed must cover the edge cases
+	all, _, err := p.ListRanges(ctx, RangeFilter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, zeroDenomination, clientDenomination := false, false, false
+	for _, summary := range all {
+		empty = empty || len(summary.Totals) == 0
+		for _, total := range summary.Totals {
+			for _, denomination := range total.Denominations {
+				zeroDenomination = zeroDenomination || denomination.Count == 0
+				clientDenomination = clientDenomination || denomination.Value == 700
+			}
+		}
+	}
+	if !empty || !zeroDenomination || !clientDenomination {
+		t.Errorf("seed misses empty ranges %t, zero denominations %t, client denominations %t", empty, zeroDenomination, clientDenomination)
+	}
+}
+
+func TestAuditEventsAppendOnly(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+
+	// audit_events can't be cleaned, so the actor is unique for every run
+	actor := "user:" + uuid.NewString()
+	event := AuditEvent{
+		CreatedAt: time.Now(),
+		Action:    "cash.void",
+		Actor:     actor,
+		IP:        "127.0.0.1",
+		UserAgent: "test",
+		Before:    []byte(`{"voided":false}`),
+		After:     []byte(`{"voided":true}`),
+	}
+	if err := p.AddAuditEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, statement := range []string{
+		"UPDATE audit_events SET action = 'cash.create' WHERE actor = $1",
+		"DELETE FROM audit_events WHERE actor = $1",
+	} {
+		if _, err := p.db.Exec(ctx, statement, actor); err == nil {
+			t.Errorf("%s has succeeded", statement)
+		}
+	}
+	if _, err := p.db.Exec(ctx, "TRUNCATE audit_events"); err == nil {
+		t.Error("TRUNCATE audit_events has succeeded")
+	}
+
+	events, total, err := p.ListAuditEvents(ctx, AuditFilter{Actors: []string{actor}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(events) != 1 || events[0].Action != event.Action {
+		t.Fatalf("audit events %+v, want the unchanged event", events)
+	}
+	var after struct {
+		Voided bool `json:"voided"`
+	}
+	if err := json.Unmarshal(events[0].After, &after); err != nil || !after.Voided {
+		t.Errorf("audit event after %s: %v", events[0].After, err)
+	}
+}
+
+func BenchmarkListRanges(b *testing.B) {
+	p := testPostgres(b)
+	seedRanges(b, p, 100, 20)
+	ctx := context.Background()
+
+	for _, limit := range []int{10, 50} {
+		b.Run(fmt.Sprintf("per range/limit=%d", limit), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := listRangesPerRange(ctx, p, 0, limit); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("snapshots/limit=%d", limit), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := p.ListRanges(ctx, RangeFilter{Limit: limit}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gocash/pkg/money"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when the searched record doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when the created record already exists
+var ErrConflict = errors.New("already exists")
+
+// ErrTokenReused is returned when a rotated refresh token is used again,
+// the whole family of the token is revoked then
+var ErrTokenReused = errors.New("refresh token is reused")
+
+// ErrAlreadyVoided is returned when the cash is voided twice
+var ErrAlreadyVoided = errors.New("cash is already voided")
+
+// ErrSettled is returned when the cash is changed after a range has closed it
+var ErrSettled = errors.New("cash is settled by a range")
+
+// Store keeps cashes, ranges, clients and users
+type Store interface {
+	// UseAPIKey returns the active api key of an active client and updates its last use time.
+	// Revoked keys and keys of deleted clients aren't found
+	UseAPIKey(ctx context.Context, key string) (APIKey, error)
+
+	// CreateClient saves the client, it returns ErrConflict if the name is taken
+	CreateClient(ctx context.Context, client Client) error
+	// GetClient returns the client unless it's deleted
+	GetClient(ctx context.Context, name string) (Client, error)
+	// ListClients returns page of clients which aren't deleted and their total count
+	ListClients(ctx context.Context, offset, limit int) ([]Client, int, error)
+	// UpdateClient saves detail of the client
+	UpdateClient(ctx context.Context, client Client) error
+	// SetSigningSecret replaces HMAC secret of the client, empty secret disables signing
+	SetSigningSecret(ctx context.Context, name, secret string, required bool, at time.Time) error
+	// SetClientLimits replaces rate limits and daily quota of the client
+	SetClientLimits(ctx context.Context, name string, limits ClientLimits, at time.Time) error
+	// AddAPIKeyUsage adds the requests of the usages to the counts of their api keys and days
+	AddAPIKeyUsage(ctx context.Context, usages []APIKeyUsage) error
+	// ListAPIKeyUsage returns usage of the client's api keys in the days between from and to inclusive
+	ListAPIKeyUsage(ctx context.Context, client string, from, to time.Time) ([]APIKeyUsage, error)
+	// ClaimNonce saves the nonce of the client's signed request until expiresAt.
+	// It returns ErrConflict if the nonce has been used and hasn't expired yet
+	ClaimNonce(ctx context.Context, client, nonce string, expiresAt time.Time) error
+	// DeleteClient marks the client deleted and revokes its api keys, the name stays taken
+	DeleteClient(ctx context.Context, name string, at time.Time) error
+
+	// CreateAPIKey saves a new key of the client
+	CreateAPIKey(ctx context.Context, key APIKey) error
+	// ListAPIKeys returns keys of the client including revoked ones, newest first
+	ListAPIKeys(ctx context.Context, client string) ([]APIKey, error)
+	// RevokeAPIKey revokes the key of the client, revoking it again keeps the first revoke time
+	RevokeAPIKey(ctx context.Context, client string, id uuid.UUID, at time.Time) (APIKey, error)
+
+	// CreateCash saves the cash. If the idempotency key has been used by the client
+	// it returns the original cash and true instead of saving a new one
+	CreateCash(ctx context.Context, cash Cash, idempotency Idempotency) (Cash, bool, error)
+	// CreateCashes saves all cashes in one transaction like CreateCash does
+	CreateCashes(ctx context.Context, submissions []CashSubmission) ([]CashResult, error)
+	GetCash(ctx context.Context, id uuid.UUID) (Cash, error)
+	// ListCashes returns filtered page of cashes and total count of filtered cashes
+	ListCashes(ctx context.Context, filter CashFilter) ([]Cash, int, error)
+	// VoidCash marks the open cash as voided by the user, so ranges don't count it.
+	// It returns ErrAlreadyVoided or ErrSettled when the cash can't be voided
+	VoidCash(ctx context.Context, id uuid.UUID, void Void) (Cash, error)
+
+	// CreateRange saves the range, assigns open cashes of the client to it
+	// and saves the snapshot of its totals. If the idempotency key has been used
+	// by the client it returns the original range and true instead
+	CreateRange(ctx context.Context, r Range, idempotency Idempotency) (RangeSummary, bool, error)
+	// ListRanges returns filtered page of range summaries and total count of filtered ranges
+	ListRanges(ctx context.Context, filter RangeFilter) ([]RangeSummary, int, error)
+
+	// Denominations returns note values of the client's currency which range summaries are broken down by.
+	// Client's own denominations take precedence over defaults of the currency
+	Denominations(ctx context.Context, client, currency string) ([]money.Amount, error)
+	// SetDenominations replaces denominations of the client's currency,
+	// empty client sets defaults of the currency
+	SetDenominations(ctx context.Context, client, currency string, values []money.Amount) error
+
+	UserByUsername(ctx context.Context, username string) (User, error)
+	// CreateUser saves the user, it returns ErrConflict if the username is taken
+	CreateUser(ctx context.Context, user User) error
+	// ListUsers returns page of users ordered by username and their total count
+	ListUsers(ctx context.Context, offset, limit int) ([]User, int, error)
+	// SetUserPassword replaces the password hash of the user
+	SetUserPassword(ctx context.Context, username, password string, at time.Time) error
+	// SetUserRole replaces role and assigned clients of the user
+	SetUserRole(ctx context.Context, username, role string, clients []string, at time.Time) error
+	// SetUserDisabled disables or enables the user
+	SetUserDisabled(ctx context.Context, username string, disabled bool, at time.Time) error
+	DeleteUser(ctx context.Context, username string) error
+
+	// SetTOTPSecret saves pending TOTP secret of the user, empty secret disables two-factor authentication.
+	// Recovery codes of the previous secret are removed
+	SetTOTPSecret(ctx context.Context, username, secret string, at time.Time) error
+	// EnableTOTP confirms the pending secret with the used code step and saves the recovery code hashes
+	EnableTOTP(ctx context.Context, username string, step int64, recoveryCodes []string, at time.Time) error
+	// UseTOTPStep marks the step used, it returns ErrConflict if the step or a later one has been used
+	UseTOTPStep(ctx context.Context, username string, step int64) error
+	// UseChallenge marks the login challenge token used until expiresAt,
+	// it returns ErrConflict if the token has been used
+	UseChallenge(ctx context.Context, id uuid.UUID, expiresAt time.Time) error
+	// SetRecoveryCodes replaces recovery code hashes of the user
+	SetRecoveryCodes(ctx context.Context, username string, recoveryCodes []string) error
+	// UseRecoveryCode marks the code hash used, it returns ErrNotFound for unknown and used codes
+	UseRecoveryCode(ctx context.Context, username, recoveryCode string, at time.Time) error
+	// TwoFactorRoles returns roles required to log in with two-factor authentication
+	TwoFactorRoles(ctx context.Context) ([]string, error)
+	SetTwoFactorRoles(ctx context.Context, roles []string) error
+
+	// CreateRefreshToken saves a refresh token issued by a login
+	CreateRefreshToken(ctx context.Context, token RefreshToken) error
+	// RotateRefreshToken marks the token used and saves next token in its family.
+	// Revoked, expired and unknown tokens aren't found. Using a token twice revokes
+	// its family and returns ErrTokenReused
+	RotateRefreshToken(ctx context.Context, id uuid.UUID, next RefreshToken) (RefreshToken, error)
+	// RevokeRefreshTokenFamily revokes every token in the family of the token
+	RevokeRefreshTokenFamily(ctx context.Context, id uuid.UUID, at time.Time) error
+	// RevokeUserRefreshTokens revokes every token of the user
+	RevokeUserRefreshTokens(ctx context.Context, username string, at time.Time) error
+
+	// LoginAttempt returns failed logins of the key since the time, zero attempt when there is none
+	LoginAttempt(ctx context.Context, key string, since time.Time) (LoginAttempt, error)
+	// AddLoginFailure counts a failed login of the key, failures before since are forgotten
+	// and counters of the keys without failures since then are deleted
+	AddLoginFailure(ctx context.Context, key string, at, since time.Time) (LoginAttempt, error)
+	// ClearLoginFailures forgets failed logins of the key
+	ClearLoginFailures(ctx context.Context, key string) error
+
+	// AddAuditEvent appends the event to the audit log, events are never changed
+	AddAuditEvent(ctx context.Context, event AuditEvent) error
+	// ListAuditEvents returns filtered page of events, newest first, and total count of filtered events
+	ListAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, int, error)
+
+	Close()
+}
+
+// Idempotency identifies repeated submissions of the same request by a client.
+// Keys used before Since are expired and can be used again, empty key disables it
+type Idempotency struct {
+	Key   string
+	Since time.Time
+}
+
+type Cash struct {
+	UUID      uuid.UUID
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// InsertedAt is the time reported by the device, nil if the device hasn't sent it
+	InsertedAt *time.Time
+	// ClockSkewed is set when InsertedAt is outside of the allowed clock skew window
+	ClockSkewed bool
+	Client      string
+	Contact     string
+	Amount      money.Amount
+	Currency    string
+	Detail      string
+	Note        string
+	// RangeUUID is the range which has closed the cash, nil while the cash is open
+	RangeUUID *uuid.UUID
+	// Void is set when the cash has been voided
+	Void *Void
+}
+
+// Void is who, when and why has voided a cash
+type Void struct {
+	At     time.Time
+	By     string
+	Reason string
+}
+
+// CashSubmission is a cash with its idempotency key
+type CashSubmission struct {
+	Cash        Cash
+	Idempotency Idempotency
+}
+
+// CashResult is the saved cash, or the original one if the submission is a duplicate
+type CashResult struct {
+	Cash      Cash
+	Duplicate bool
+}
+
+// CashFilter filters cashes by case insensitive regular expressions of the fields
+// and by exact amounts, currencies and clients. Available pattern fields: uuid, range_uuid, client, contact, detail, note.
+// Voided cashes are skipped unless IncludeVoided is set
+type CashFilter struct {
+	Patterns      map[string]string
+	Amounts       []money.Amount
+	Currencies    []string
+	Clients       []string
+	IncludeVoided bool
+	// Clock is the time cashes are filtered by From and To and ordered by
+	Clock  Clock
+	From   *time.Time
+	To     *time.Time
+	Offset int
+	Limit  int
+}
+
+// Client is an organization whose devices post cashes and ranges
+type Client struct {
+	Name      string
+	Detail    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time
+	// SigningSecret is HMAC secret of signed requests, empty when signing isn't set up.
+	// Unsigned requests are rejected if SignatureRequired is set
+	SigningSecret     string
+	SignatureRequired bool
+	Limits            ClientLimits
+}
+
+// ClientLimits limit device requests of the client, nil values use the service defaults
+type ClientLimits struct {
+	// RateLimit is requests per second of each api key, RateBurst is count of requests allowed at once
+	RateLimit *float64
+	RateBurst *int
+	// DailyQuota is requests per UTC day of all api keys, 0 is unlimited
+	DailyQuota *int64
+}
+
+// APIKeyUsage is count of device requests made with the api key in a UTC day
+type APIKeyUsage struct {
+	APIKey   uuid.UUID
+	Client   string
+	Day      time.Time
+	Requests int64
+}
+
+// APIKey authenticates devices of a client, only the hash of the key is kept
+type APIKey struct {
+	UUID       uuid.UUID
+	Client     string
+	Prefix     string
+	KeyHash    string
+	Label      string
+	CreatedAt  time.Time
+	RevokedAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+type Range struct {
+	UUID      uuid.UUID
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Client    string
+	Detail    string
+	Note      string
+}
+
+// RangeFilter filters ranges by exact clients, empty Clients doesn't filter
+type RangeFilter struct {
+	Clients []string
+	Offset  int
+	Limit   int
+}
+
+// RangeSummary is a range with totals of the cashes it has closed.
+// Totals are computed once when the range is created and never change
+type RangeSummary struct {
+	Range
+	Totals []CurrencySummary
+}
+
+// CurrencySummary is sum of cashes in one currency broken down by denominations
+type CurrencySummary struct {
+	Currency      string
+	TotalAmount   money.Amount
+	Denominations []DenominationSummary
+}
+
+// DenominationSummary is count and sum of cashes with the same note value
+type DenominationSummary struct {
+	Value       money.Amount
+	Count       uint
+	TotalAmount money.Amount
+}
+
+// User is an operator of the service, Password is bcrypt hash.
+// Users with Clients see only data of those clients
+type User struct {
+	Username   string
+	Password   string
+	Role       string
+	Clients    []string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	DisabledAt *time.Time
+	// TOTPSecret is pending until TOTPEnabledAt is set
+	TOTPSecret    string
+	TOTPEnabledAt *time.Time
+}
+
+// RefreshToken is a refresh token issued to a user, ID is jti claim of the token
+type RefreshToken struct {
+	ID        uuid.UUID
+	Family    uuid.UUID
+	Username  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// LoginAttempt counts failed logins of a username or an IP
+type LoginAttempt struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+}
+
+// AuditEvent is a mutating operation done by an actor, which is a user or an api key.
+// Before and After are JSON of the changed resource, nil when it doesn't apply
+type AuditEvent struct {
+	ID           int64
+	CreatedAt    time.Time
+	Action       string
+	Actor        string
+	Client       string
+	IP           string
+	UserAgent    string
+	ResourceUUID *uuid.UUID
+	Before       json.RawMessage
+	After        json.RawMessage
+}
+
+// AuditFilter filters audit events by exact actors, actions and clients and by period
+type AuditFilter struct {
+	Actors  []string
+	Actions []string
+	Clients []string
+	From    *time.Time
+	To      *time.Time
+	Offset  int
+	Limit   int
+}
+
+// Clock is the time of a cash which reports use
+type Clock string
+
+const (
+	// ClockServer is the time the server has received the cash
+	ClockServer Clock = "server"
+	// ClockDevice is the time the device has accepted the cash,
+	// server time is used if the device hasn't reported it
+	ClockDevice Clock = "device"
+)
+
+// Time returns time of the cash by the clock
+func (c Clock) Time(cash Cash) time.Time {
+	if c == ClockDevice && cash.InsertedAt != nil {
+		return *cash.InsertedAt
+	}
+	return cash.CreatedAt
+}
+
+// CashFilterFields are fields which cashes can be filtered by patterns
+var CashFilterFields = []string{"uuid", "range_uuid", "client", "contact", "detail", "note"}
@@ -0,0 +1,71 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 appendix B codes of SHA1, the last Digits digits of the 8 digit codes
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range rfcVectors {
+		code, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != v.code {
+			t.Errorf("Code at %d = %s, want %s", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	code := "050471"
+	step := Step(at)
+
+	if got, ok := Validate(rfcSecret, code, at); !ok || got != step {
+		t.Errorf("Validate at the step = %d, %t, want %d, true", got, ok, step)
+	}
+	// Codes of the neighbouring steps are accepted for clock drift
+	for _, skew := range []int64{-Skew, Skew} {
+		if got, ok := Validate(rfcSecret, code, at.Add(time.Duration(skew)*Period)); !ok || got != step {
+			t.Errorf("Validate %d steps away = %d, %t, want %d, true", skew, got, ok, step)
+		}
+	}
+	if _, ok := Validate(rfcSecret, code, at.Add(time.Duration(Skew+1)*Period)); ok {
+		t.Errorf("Validate outside the skew is ok")
+	}
+	for _, wrong := range []string{"050472", "50471", "0504711", ""} {
+		if _, ok := Validate(rfcSecret, wrong, at); ok {
+			t.Errorf("Validate(%q) is ok", wrong)
+		}
+	}
+	if _, ok := Validate(rfcSecret, " 050471 ", at); !ok {
+		t.Errorf("Validate doesn't trim spaces")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Errorf("generated secret %q isn't base32: %v", secret, err)
+	}
+}
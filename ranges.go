@@ -0,0 +1,169 @@
+package main
+
+import (
+	"gocash/pkg/logger"
+	"gocash/pkg/money"
+	"gocash/pkg/store"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RangeBody closes open cashes of the client.
+// Repeated bodies with the same idempotency key (Idempotency-Key header or
+// idempotency_key field) return the original range
+type RangeBody struct {
+	// Deprecated: APIKey is read by DeviceAuth only when X-API-Key header is empty
+	APIKey         string `json:"api_key"`
+	Detail         string `json:"detail"`
+	Note           string `json:"note"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+type RangeBodyResponse struct {
+	UUID      uuid.UUID       `json:"uuid"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Client    string          `json:"client"`
+	Detail    string          `json:"detail"`
+	Note      string          `json:"note"`
+	Totals    []CurrencyTotal `json:"totals"`
+}
+
+// CurrencyTotal is sum of the range cashes in one currency
+type CurrencyTotal struct {
+	Currency      string         `json:"currency"`
+	TotalAmount   money.Amount   `json:"total_amount"`
+	Denominations []Denomination `json:"denominations"`
+}
+
+// Denomination is sum and count (amount) of the cashes with the same note value
+type Denomination struct {
+	Value       money.Amount `json:"value"`
+	TotalAmount money.Amount `json:"total_amount"`
+	Amount      uint         `json:"amount"`
+}
+
+func newRangeBodyResponse(summary store.RangeSummary) RangeBodyResponse {
+	totals := make([]CurrencyTotal, 0, len(summary.Totals))
+	for _, t := range summary.Totals {
+		denominations := make([]Denomination, 0, len(t.Denominations))
+		for _, d := range t.Denominations {
+			denominations = append(denominations, Denomination{
+				Value:       d.Value,
+				TotalAmount: d.TotalAmount,
+				Amount:      d.Count,
+			})
+		}
+		totals = append(totals, CurrencyTotal{
+			Currency:      t.Currency,
+			TotalAmount:   t.TotalAmount,
+			Denominations: denominations,
+		})
+	}
+
+	return RangeBodyResponse{
+		UUID:      summary.UUID,
+		CreatedAt: summary.CreatedAt,
+		UpdatedAt: summary.UpdatedAt,
+		Client:    summary.Client,
+		Detail:    summary.Detail,
+		Note:      summary.Note,
+		Totals:    totals,
+	}
+}
+
+func (s *Server) createRange(ctx *gin.Context) {
+	// Get request body
+	var body RangeBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(400, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	idempotency, err := s.Idempotency(ctx, body.IdempotencyKey)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":   err.Error(),
+			"message": "Idempotency key invalid",
+		})
+		return
+	}
+
+	// Find the client with the given key
+	apiKey := CurrentAPIKey(ctx)
+	client := apiKey.Client
+
+	// Insert request to database
+	r := store.Range{
+		UUID:      uuid.New(),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Client:    client,
+		Detail:    body.Detail,
+		Note:      body.Note,
+	}
+	summary, duplicate, err := s.store.CreateRange(ctx, r, idempotency)
+	if err != nil {
+		logger.Errorf("database save error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't save into ranges",
+		})
+		return
+	}
+
+	if duplicate {
+		ctx.Header("Idempotent-Replayed", "true")
+	} else {
+		s.audit(ctx, AuditEntry{
+			Action:       AuditRangeCreate,
+			Actor:        apiKeyActor(apiKey),
+			Client:       client,
+			ResourceUUID: &summary.UUID,
+			After:        newRangeBodyResponse(summary),
+		})
+	}
+
+	// Send success result
+	ctx.JSON(201, gin.H{
+		"message": "Successfully saved into database",
+		"uuid":    summary.UUID.String(),
+		"totals":  newRangeBodyResponse(summary).Totals,
+	})
+}
+
+func (s *Server) listRanges(ctx *gin.Context) {
+	offset, limit := Paginate(ctx)
+
+	// Find ranges with their summaries
+	summaries, total, err := s.store.ListRanges(ctx, store.RangeFilter{
+		Clients: ScopedClients(ctx),
+		Offset:  offset,
+		Limit:   limit,
+	})
+	if err != nil {
+		logger.Errorf("ranges search error %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Something went wrong",
+		})
+		return
+	}
+
+	resultRanges := make([]RangeBodyResponse, 0, len(summaries))
+	for _, summary := range summaries {
+		resultRanges = append(resultRanges, newRangeBodyResponse(summary))
+	}
+
+	ctx.JSON(200, gin.H{
+		"ranges": resultRanges,
+		"total":  total,
+	})
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"gocash/pkg/logger"
+	"gocash/pkg/ratelimit"
+	"gocash/pkg/store"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// dayLayout is the format of the usage days
+const dayLayout = "2006-01-02"
+
+// usageDays is the default period of /clients/:name/usage
+const usageDays = 30
+
+// ClientLimitsBody replaces limits of a client, omitted values use the service defaults
+type ClientLimitsBody struct {
+	RateLimit  *float64 `json:"rate_limit" binding:"omitempty,gte=0"`
+	RateBurst  *int     `json:"rate_burst" binding:"omitempty,gte=1"`
+	DailyQuota *int64   `json:"daily_quota" binding:"omitempty,gte=0"`
+}
+
+// APIKeyUsageResponse is count of requests of an api key in a UTC day
+type APIKeyUsageResponse struct {
+	APIKey   string `json:"api_key"`
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+}
+
+// apiKeyCache keeps looked up api keys with their clients for the ttl,
+// so devices don't hit the database on every request
+type apiKeyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	apiKey    store.APIKey
+	client    store.Client
+	expiresAt time.Time
+}
+
+func newAPIKeyCache(ttl time.Duration) *apiKeyCache {
+	return &apiKeyCache{ttl: ttl, entries: map[string]cachedAPIKey{}}
+}
+
+// get returns the entry of the key hash unless it's expired
+func (c *apiKeyCache) get(hash string, now time.Time) (cachedAPIKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[hash]
+	if !ok || now.After(entry.expiresAt) {
+		delete(c.entries, hash)
+		return cachedAPIKey{}, false
+	}
+	return entry, true
+}
+
+func (c *apiKeyCache) put(hash string, apiKey store.APIKey, client store.Client, now time.Time) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[hash] = cachedAPIKey{apiKey: apiKey, client: client, expiresAt: now.Add(c.ttl)}
+}
+
+// purge drops all entries, so revoked keys and changed clients apply right away in this process.
+// Other processes see the changes after the ttl
+func (c *apiKeyCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]cachedAPIKey{}
+}
+
+// usageCounter counts device requests in memory and adds them to the store in batches.
+// Day counts of the clients are read from the store when they're first needed and after every flush,
+// so requests served by other processes count against the quota once they're flushed
+type usageCounter struct {
+	mu      sync.Mutex
+	pending map[usageKey]int64
+	counts  map[clientDay]int64
+}
+
+type usageKey struct {
+	apiKey uuid.UUID
+	client string
+	day    time.Time
+}
+
+type clientDay struct {
+	client string
+	day    time.Time
+}
+
+func newUsageCounter() *usageCounter {
+	return &usageCounter{pending: map[usageKey]int64{}, counts: map[clientDay]int64{}}
+}
+
+// add counts a request of the api key in the UTC day unless the client's count of the day
+// has reached the quota, 0 is unlimited. Requests over the quota aren't counted
+func (u *usageCounter) add(ctx context.Context, st store.Store, apiKey store.APIKey, day time.Time, quota int64) (bool, error) {
+	k := clientDay{client: apiKey.Client, day: day}
+	u.mu.Lock()
+	_, known := u.counts[k]
+	u.mu.Unlock()
+	if !known {
+		stored, err := storedUsage(ctx, st, k)
+		if err != nil {
+			return false, err
+		}
+		u.mu.Lock()
+		if _, known := u.counts[k]; !known {
+			u.counts[k] = stored
+		}
+		u.mu.Unlock()
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if quota > 0 && u.counts[k] >= quota {
+		return false, nil
+	}
+	u.pending[usageKey{apiKey: apiKey.UUID, client: apiKey.Client, day: day}]++
+	u.counts[k]++
+	return true, nil
+}
+
+// flush adds the pending requests to the store and reloads day counts of their clients.
+// Requests which couldn't be saved stay pending
+func (u *usageCounter) flush(ctx context.Context, st store.Store) error {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = map[usageKey]int64{}
+	u.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	usages := make([]store.APIKeyUsage, 0, len(pending))
+	flushed := map[clientDay]bool{}
+	for k, requests := range pending {
+		usages = append(usages, store.APIKeyUsage{APIKey: k.apiKey, Client: k.client, Day: k.day, Requests: requests})
+		flushed[clientDay{client: k.client, day: k.day}] = true
+	}
+	if err := st.AddAPIKeyUsage(ctx, usages); err != nil {
+		u.mu.Lock()
+		for k, requests := range pending {
+			u.pending[k] += requests
+		}
+		u.mu.Unlock()
+		return err
+	}
+
+	for k := range flushed {
+		stored, err := storedUsage(ctx, st, k)
+		if err != nil {
+			return err
+		}
+		u.mu.Lock()
+		// Requests counted since the swap aren't in the store yet
+		for p, requests := range u.pending {
+			if p.client == k.client && p.day.Equal(k.day) {
+				stored += requests
+			}
+		}
+		u.counts[k] = stored
+		u.mu.Unlock()
+	}
+
+	// Counts of the past days aren't needed anymore
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	u.mu.Lock()
+	for k := range u.counts {
+		if k.day.Before(today) {
+			delete(u.counts, k)
+		}
+	}
+	u.mu.Unlock()
+	return nil
+}
+
+// storedUsage returns the client's count of the day in the store
+func storedUsage(ctx context.Context, st store.Store, k clientDay) (int64, error) {
+	usages, err := st.ListAPIKeyUsage(ctx, k.client, k.day, k.day)
+	if err != nil {
+		return 0, err
+	}
+	var requests int64
+	for _, usage := range usages {
+		requests += usage.Requests
+	}
+	return requests, nil
+}
+
+// FlushUsage adds the counted device requests to the store
+func (s *Server) FlushUsage(ctx context.Context) error {
+	return s.usage.flush(ctx, s.store)
+}
+
+// FlushUsageEvery flushes the counted device requests every device.usage_flush_interval until ctx is done
+func (s *Server) FlushUsageEvery(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Device.UsageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.FlushUsage(ctx); err != nil {
+				logger.Errorf("usage flush error %v", err)
+			}
+		}
+	}
+}
+
+// deviceLimit returns the rate limit of the client's api keys
+func (s *Server) deviceLimit(client store.Client) ratelimit.Limit {
+	limit := ratelimit.Limit{Rate: s.config.Device.RateLimit, Burst: s.config.Device.RateBurst}
+	if client.Limits.RateLimit != nil {
+		limit.Rate = *client.Limits.RateLimit
+	}
+	if client.Limits.RateBurst != nil {
+		limit.Burst = *client.Limits.RateBurst
+	}
+	return limit
+}
+
+// dailyQuota returns requests allowed to the client in a UTC day, 0 is unlimited
+func (s *Server) dailyQuota(client store.Client) int64 {
+	if client.Limits.DailyQuota != nil {
+		return *client.Limits.DailyQuota
+	}
+	return s.config.Device.DailyQuota
+}
+
+// retryAfter sets Retry-After header in whole seconds
+func retryAfter(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+}
+
+// DeviceRateLimit limits requests of the api key authenticated by DeviceAuth
+func (s *Server) DeviceRateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey, client := CurrentAPIKey(c), CurrentClient(c)
+		if ok, wait := s.limiter.Allow("api_key:"+apiKey.UUID.String(), s.deviceLimit(client), time.Now()); !ok {
+			retryAfter(c, wait)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":   "rate_limited",
+				"message": "Too many requests, slow down",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// DeviceQuota counts requests of the api key against the client's daily quota.
+// It runs after SignatureAuth, so forged requests don't use up the quota
+func (s *Server) DeviceQuota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey, client := CurrentAPIKey(c), CurrentClient(c)
+		now := time.Now()
+		day := now.UTC().Truncate(24 * time.Hour)
+		allowed, err := s.usage.add(c, s.store, apiKey, day, s.dailyQuota(client))
+		if err != nil {
+			storeError(c, err, "Couldn't count the request")
+			c.Abort()
+			return
+		}
+		if !allowed {
+			retryAfter(c, day.Add(24*time.Hour).Sub(now))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":   "quota_exceeded",
+				"message": "Daily quota of the client is used up",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// LoginRateLimit limits login requests of an IP
+func (s *Server) LoginRateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := ratelimit.Limit{Rate: s.config.Login.RateLimit, Burst: s.config.Login.RateBurst}
+		if ok, wait := s.limiter.Allow("ip:"+c.ClientIP(), limit, time.Now()); !ok {
+			retryAfter(c, wait)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":   "rate_limited",
+				"message": "Too many requests, slow down",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *Server) setClientLimits(ctx *gin.Context) {
+	var body ClientLimitsBody
+	if err := ctx.BindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	before, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+	limits := store.ClientLimits{
+		RateLimit:  body.RateLimit,
+		RateBurst:  body.RateBurst,
+		DailyQuota: body.DailyQuota,
+	}
+	if err := s.store.SetClientLimits(ctx, before.Name, limits, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't save the limits")
+		return
+	}
+	s.apiKeys.purge()
+
+	client, err := s.store.GetClient(ctx, before.Name)
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditClientLimitsSet,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Client: client.Name,
+		Before: newClientResponse(before),
+		After:  newClientResponse(client),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"client": newClientResponse(client),
+	})
+}
+
+// /clients/:name/usage
+// Filters: from, to as UTC days like 2006-01-02, the last 30 days by default
+func (s *Server) listClientUsage(ctx *gin.Context) {
+	client, err := s.store.GetClient(ctx, ctx.Param("name"))
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the client")
+		return
+	}
+
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, -usageDays+1)
+	for key, day := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := ctx.Query(key)
+		if value == "" {
+			continue
+		}
+		if *day, err = time.Parse(dayLayout, value); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"message": "Query " + key + " invalid",
+			})
+			return
+		}
+	}
+
+	usages, err := s.store.ListAPIKeyUsage(ctx, client.Name, from, to)
+	if err != nil {
+		storeError(ctx, err, "Couldn't search from usage")
+		return
+	}
+
+	result := make([]APIKeyUsageResponse, 0, len(usages))
+	for _, usage := range usages {
+		result = append(result, APIKeyUsageResponse{
+			APIKey:   usage.APIKey.String(),
+			Day:      usage.Day.Format(dayLayout),
+			Requests: usage.Requests,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"usage":       result,
+		"daily_quota": s.dailyQuota(client),
+		"rate_limit":  s.deviceLimit(client).Rate,
+		"rate_burst":  s.deviceLimit(client).Burst,
+	})
+}
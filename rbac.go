@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"gocash/pkg/arrs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles of users
+const (
+	RoleAdmin      = "admin"
+	RoleAccountant = "accountant"
+	RoleCollector  = "collector"
+	RoleViewer     = "viewer"
+)
+
+// Permission is an operation which a role can be allowed
+type Permission string
+
+const (
+	PermCashesRead         Permission = "cashes:read"
+	PermCashesVoid         Permission = "cashes:void"
+	PermRangesRead         Permission = "ranges:read"
+	PermDenominationsRead  Permission = "denominations:read"
+	PermDenominationsWrite Permission = "denominations:write"
+	PermAuditRead          Permission = "audit:read"
+	PermClientsManage      Permission = "clients:manage"
+	PermUsersManage        Permission = "users:manage"
+)
+
+// rolePermissions are permissions of the roles, admin has every permission
+var rolePermissions = map[string][]Permission{
+	RoleAccountant: {PermCashesRead, PermCashesVoid, PermRangesRead, PermDenominationsRead, PermDenominationsWrite, PermAuditRead},
+	RoleCollector:  {PermCashesRead, PermRangesRead, PermDenominationsRead},
+	RoleViewer:     {PermCashesRead, PermRangesRead},
+}
+
+// validRole returns error if the role is unknown
+func validRole(role string) error {
+	if _, ok := rolePermissions[role]; !ok && role != RoleAdmin {
+		return fmt.Errorf("unknown role %q, available roles: admin, accountant, collector, viewer", role)
+	}
+	return nil
+}
+
+// hasPermission checks if the role is allowed the permission
+func hasPermission(role string, permission Permission) bool {
+	if role == RoleAdmin {
+		return true
+	}
+	return arrs.Contains(rolePermissions[role], permission)
+}
+
+// Require allows the request only if the role of the user authenticated by Auth has the permission
+func Require(permission Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(CurrentClaims(c).User.Role, permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":   "permission_denied",
+				"message": fmt.Sprintf("Permission %s is required", permission),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ScopedClients returns clients which the authenticated user is restricted to,
+// nil means the user sees every client. Admins are never restricted
+func ScopedClients(c *gin.Context) []string {
+	user := CurrentClaims(c).User
+	if user.Role == RoleAdmin || len(user.Clients) == 0 {
+		return nil
+	}
+	return user.Clients
+}
+
+// inScope checks if the client is visible to the authenticated user
+func inScope(c *gin.Context, client string) bool {
+	clients := ScopedClients(c)
+	return clients == nil || arrs.Contains(clients, client)
+}
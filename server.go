@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gocash/pkg/config"
+	"gocash/pkg/keyset"
+	"gocash/pkg/logger"
+	"gocash/pkg/ratelimit"
+	"gocash/pkg/store"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server holds dependencies of the HTTP handlers
+type Server struct {
+	config  config.Config
+	store   store.Store
+	keys    *keyset.KeySet
+	limiter *ratelimit.Limiter
+	usage   *usageCounter
+	apiKeys *apiKeyCache
+}
+
+func NewServer(cfg config.Config, st store.Store, keys *keyset.KeySet) *Server {
+	return &Server{
+		config:  cfg,
+		store:   st,
+		keys:    keys,
+		limiter: ratelimit.New(),
+		usage:   newUsageCounter(),
+		apiKeys: newAPIKeyCache(cfg.Device.APIKeyCacheTTL),
+	}
+}
+
+// Router registers all routes of the service
+func (s *Server) Router() *gin.Engine {
+	r := gin.Default()
+	// X-Forwarded-For is read only from the trusted proxies, the config has validated them
+	if err := r.SetTrustedProxies(s.config.HTTP.TrustedProxies); err != nil {
+		logger.Fatalf("couldn't set trusted proxies %v", err)
+	}
+	r.Use(s.LimitBody())
+
+	r.POST("/cashes", s.DeviceAuth(), s.DeviceRateLimit(), s.SignatureAuth(), s.DeviceQuota(), s.createCash)
+	r.POST("/cashes/batch", s.DeviceAuth(), s.DeviceRateLimit(), s.SignatureAuth(), s.DeviceQuota(), s.createCashBatch)
+	r.GET("/cashes", s.Auth(), Require(PermCashesRead), s.listCashes)
+	r.GET("/cashes/:uuid", s.Auth(), Require(PermCashesRead), s.getCash)
+	r.POST("/cashes/:uuid/void", s.Auth(), Require(PermCashesVoid), s.voidCash)
+
+	r.POST("/ranges", s.DeviceAuth(), s.DeviceRateLimit(), s.SignatureAuth(), s.DeviceQuota(), s.createRange)
+	r.GET("/ranges", s.Auth(), Require(PermRangesRead), s.listRanges)
+
+	r.POST("/clients", s.Auth(), Require(PermClientsManage), s.createClient)
+	r.GET("/clients", s.Auth(), Require(PermClientsManage), s.listClients)
+	r.GET("/clients/:name", s.Auth(), Require(PermClientsManage), s.getClient)
+	r.PUT("/clients/:name", s.Auth(), Require(PermClientsManage), s.updateClient)
+	r.DELETE("/clients/:name", s.Auth(), Require(PermClientsManage), s.deleteClient)
+	r.POST("/clients/:name/keys", s.Auth(), Require(PermClientsManage), s.createAPIKey)
+	r.GET("/clients/:name/keys", s.Auth(), Require(PermClientsManage), s.listAPIKeys)
+	r.DELETE("/clients/:name/keys/:uuid", s.Auth(), Require(PermClientsManage), s.revokeAPIKey)
+	r.POST("/clients/:name/signing-secret", s.Auth(), Require(PermClientsManage), s.createSigningSecret)
+	r.DELETE("/clients/:name/signing-secret", s.Auth(), Require(PermClientsManage), s.deleteSigningSecret)
+	r.PUT("/clients/:name/limits", s.Auth(), Require(PermClientsManage), s.setClientLimits)
+	r.GET("/clients/:name/usage", s.Auth(), Require(PermClientsManage), s.listClientUsage)
+
+	r.GET("/denominations", s.Auth(), Require(PermDenominationsRead), s.getDenominations)
+	r.PUT("/denominations", s.Auth(), Require(PermDenominationsWrite), s.setDenominations)
+
+	r.POST("/login", s.LoginRateLimit(), s.login)
+	r.POST("/login/2fa", s.LoginRateLimit(), s.loginTwoFactor)
+	r.POST("/login/2fa/enroll", s.LoginRateLimit(), s.enrollLogin)
+	r.POST("/token", s.token)
+	r.POST("/logout", s.logout)
+	r.POST("/logout/all", s.Auth(), s.logoutAll)
+	r.GET("/.well-known/jwks.json", s.jwks)
+
+	r.POST("/users", s.Auth(), Require(PermUsersManage), s.createUser)
+	r.GET("/users", s.Auth(), Require(PermUsersManage), s.listUsers)
+	r.DELETE("/users/:username", s.Auth(), Require(PermUsersManage), s.deleteUser)
+	r.PUT("/users/:username/role", s.Auth(), Require(PermUsersManage), s.setUserRole)
+	r.POST("/users/:username/disable", s.Auth(), Require(PermUsersManage), s.setUserDisabled(true))
+	r.POST("/users/:username/enable", s.Auth(), Require(PermUsersManage), s.setUserDisabled(false))
+	r.PUT("/users/:username/password", s.Auth(), Require(PermUsersManage), s.resetUserPassword)
+	r.POST("/users/:username/unlock", s.Auth(), Require(PermUsersManage), s.unlockUser)
+	r.POST("/users/:username/2fa/reset", s.Auth(), Require(PermUsersManage), s.resetTwoFactor)
+	r.PUT("/me/password", s.Auth(), s.changePassword)
+	r.POST("/me/2fa", s.Auth(), s.enrollTwoFactor)
+	r.POST("/me/2fa/confirm", s.Auth(), s.confirmTwoFactor)
+	r.POST("/me/2fa/disable", s.Auth(), s.disableTwoFactor)
+	r.POST("/me/2fa/recovery-codes", s.Auth(), s.regenerateRecoveryCodes)
+
+	r.GET("/policies/2fa", s.Auth(), Require(PermUsersManage), s.getTwoFactorRoles)
+	r.PUT("/policies/2fa", s.Auth(), Require(PermUsersManage), s.setTwoFactorRoles)
+
+	r.GET("/audit", s.Auth(), Require(PermAuditRead), s.listAuditEvents)
+
+	return r
+}
+
+// storeError responds with status of the store error
+func storeError(ctx *gin.Context, err error, message string) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, store.ErrConflict):
+		status = http.StatusConflict
+	default:
+		logger.Errorf("%s: %v", message, err)
+	}
+	ctx.JSON(status, gin.H{
+		"error":   err.Error(),
+		"message": message,
+	})
+}
+
+// LimitBody rejects request bodies larger than http.max_body_bytes
+func (s *Server) LimitBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		maxBytes := s.config.HTTP.MaxBodyBytes
+		if c.Request.ContentLength > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error":   "body_too_large",
+				"message": fmt.Sprintf("Request body is larger than %d bytes", maxBytes),
+			})
+			return
+		}
+		// Bodies without Content-Length fail to read past the limit
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
+
+// maxIdempotencyKeyLength is the size of idempotency_keys.key column
+const maxIdempotencyKeyLength = 255
+
+// Idempotency reads Idempotency-Key header, bodyKey is used when the header is empty
+func (s *Server) Idempotency(ctx *gin.Context, bodyKey string) (store.Idempotency, error) {
+	key := ctx.GetHeader("Idempotency-Key")
+	if key == "" {
+		key = bodyKey
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return store.Idempotency{}, fmt.Errorf("idempotency key is longer than %d characters", maxIdempotencyKeyLength)
+	}
+	return store.Idempotency{
+		Key:   key,
+		Since: time.Now().Add(-s.config.IdempotencyKeyTTL),
+	}, nil
+}
+
+// Period reads from and to query params as RFC 3339 times, nil when they're empty
+func Period(ctx *gin.Context) (from, to *time.Time, err error) {
+	parse := func(key string) (*time.Time, error) {
+		value := ctx.Query(key)
+		if value == "" {
+			return nil, nil
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return &t, nil
+	}
+	if from, err = parse("from"); err != nil {
+		return nil, nil, err
+	}
+	if to, err = parse("to"); err != nil {
+		return nil, nil, err
+	}
+	return from, to, nil
+}
+
+func Paginate(ctx *gin.Context) (offset, limit int) {
+	offset, limit = 0, 20
+	// Prepare pagination details
+	offsetQuery := ctx.DefaultQuery("offset", "0")
+	limitQuery := ctx.DefaultQuery("limit", "20")
+
+	offset, err := strconv.Atoi(offsetQuery)
+	if err != nil {
+		offset = 0
+	}
+	limit, err = strconv.Atoi(limitQuery)
+	if err != nil {
+		limit = 50
+	}
+	return offset, limit
+
+}
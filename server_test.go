@@ -0,0 +1,1839 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gocash/pkg/config"
+	"gocash/pkg/keyset"
+	"gocash/pkg/store"
+	"gocash/pkg/totp"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testAPIKey is the api key of client local in the test store
+const testAPIKey = "4f0b4c6e-8d0e-4a83-9c38-0d7f3b6f9a51"
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testServer serves an in-memory store with user admin/admin and client local,
+// options change the default configuration
+func testServer(t *testing.T, options ...func(*config.Config)) http.Handler {
+	t.Helper()
+	return newTestServer(t, options...).Router()
+}
+
+// newTestServer returns the server of testServer
+func newTestServer(t *testing.T, options ...func(*config.Config)) *Server {
+	t.Helper()
+	cfg := config.Default()
+	cfg.DatabaseURL = config.MemoryURL
+	for _, option := range options {
+		option(&cfg)
+	}
+	keys, err := keyset.Ephemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.NewMemory()
+	password, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.AddUser(store.User{Username: "admin", Password: string(password), Role: RoleAdmin, CreatedAt: time.Now(), UpdatedAt: time.Now()})
+	st.AddClient(testAPIKey, "local")
+
+	return NewServer(cfg, st, keys)
+}
+
+// do sends the request with the JSON body and decodes the response into out
+func do(t *testing.T, h http.Handler, method, path string, header http.Header, body, out interface{}) int {
+	t.Helper()
+	w := send(t, h, method, path, header, body)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s response %s: %v", method, path, w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+// send sends the request with the JSON body
+func send(t *testing.T, h http.Handler, method, path string, header http.Header, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reader)
+	req.Header.Set("Content-Type", "application/json")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// login returns the Authorization header of the admin
+func login(t *testing.T, h http.Handler) http.Header {
+	t.Helper()
+	var tokens Tokens
+	if code := do(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "admin"}, &tokens); code != http.StatusOK {
+		t.Fatalf("login status %d", code)
+	}
+	return http.Header{"Authorization": {"Bearer " + tokens.AccessToken}}
+}
+
+func TestLogin(t *testing.T) {
+	h := testServer(t)
+
+	var tokens Tokens
+	if code := do(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "admin"}, &tokens); code != http.StatusOK {
+		t.Fatalf("login status %d", code)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("tokens %+v", tokens)
+	}
+	auth := http.Header{"Authorization": {"Bearer " + tokens.AccessToken}}
+	if code := do(t, h, "GET", "/cashes", auth, nil, nil); code != http.StatusOK {
+		t.Errorf("authenticated status %d", code)
+	}
+
+	// Unknown users and wrong passwords fail the same way
+	var failed struct {
+		Error string `json:"error"`
+	}
+	for _, body := range []gin.H{
+		{"username": "admin", "password": "wrong"},
+		{"username": "nobody", "password": "admin"},
+	} {
+		if code := do(t, h, "POST", "/login", nil, body, &failed); code != http.StatusUnauthorized || failed.Error != "invalid_credentials" {
+			t.Errorf("login of %v status %d, error %s", body, code, failed.Error)
+		}
+	}
+	if code := do(t, h, "GET", "/cashes", nil, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated status %d", code)
+	}
+	if code := do(t, h, "GET", "/cashes", http.Header{"Authorization": {"Bearer wrong"}}, nil, nil); code != http.StatusForbidden {
+		t.Errorf("wrong token status %d", code)
+	}
+}
+
+func TestCashes(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	var created struct {
+		UUID string `json:"uuid"`
+	}
+	cash := gin.H{"api_key": testAPIKey, "amount": "12.50", "contact": "+99361000000", "note": "first", "currency": "usd"}
+	if code := do(t, h, "POST", "/cashes", nil, cash, &created); code != http.StatusCreated {
+		t.Fatalf("create status %d", code)
+	}
+	if code := do(t, h, "POST", "/cashes", nil, gin.H{"api_key": testAPIKey, "amount": 5, "contact": "+99362000000"}, nil); code != http.StatusCreated {
+		t.Fatalf("create status %d", code)
+	}
+	for name, body := range map[string]gin.H{
+		"without contact":  {"api_key": testAPIKey, "amount": 1},
+		"without amount":   {"api_key": testAPIKey, "contact": "c"},
+		"fractional cents": {"api_key": testAPIKey, "amount": "1.001", "contact": "c"},
+		"negative amount":  {"api_key": testAPIKey, "amount": "-1.00", "contact": "c"},
+		"unknown currency": {"api_key": testAPIKey, "amount": "1.00", "contact": "c", "currency": "XYZ"},
+		"3 minor units":    {"api_key": testAPIKey, "amount": "1.00", "contact": "c", "currency": "KWD"},
+		"fractional yen":   {"api_key": testAPIKey, "amount": "100.50", "contact": "c", "currency": "JPY"},
+	} {
+		if code := do(t, h, "POST", "/cashes", nil, body, nil); code != http.StatusBadRequest {
+			t.Errorf("create %s status %d", name, code)
+		}
+	}
+
+	var list struct {
+		Cashes []CashBodyResponse `json:"cashes"`
+		Total  int                `json:"total"`
+	}
+	if code := do(t, h, "GET", "/cashes?contact=61", auth, nil, &list); code != http.StatusOK {
+		t.Fatalf("list status %d", code)
+	}
+	if list.Total != 1 || len(list.Cashes) != 1 {
+		t.Fatalf("listed %d of %d cashes, want 1", len(list.Cashes), list.Total)
+	}
+	got := list.Cashes[0]
+	if got.UUID.String() != created.UUID || got.Amount != 1250 || got.Currency != "USD" || got.Client != "local" || got.Note != "first" {
+		t.Errorf("listed cash %+v", got)
+	}
+	if code := do(t, h, "GET", "/cashes?amount=5", auth, nil, &list); code != http.StatusOK || list.Total != 1 || list.Cashes[0].Amount != 500 {
+		t.Errorf("amount filter status %d, listed %+v", code, list.Cashes)
+	}
+	if code := do(t, h, "GET", "/cashes?amount=5.001", auth, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid amount filter status %d", code)
+	}
+	// Cashes without currency are in the default one
+	if code := do(t, h, "GET", "/cashes?currency=tmt", auth, nil, &list); code != http.StatusOK || list.Total != 1 || list.Cashes[0].Amount != 500 {
+		t.Errorf("currency filter status %d, listed %+v", code, list.Cashes)
+	}
+	if code := do(t, h, "GET", "/cashes?currency=XYZ", auth, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid currency filter status %d", code)
+	}
+	if code := do(t, h, "GET", "/cashes?limit=1", auth, nil, &list); code != http.StatusOK || list.Total != 2 || len(list.Cashes) != 1 {
+		t.Errorf("page status %d, listed %d of %d cashes", code, len(list.Cashes), list.Total)
+	}
+
+	var one struct {
+		Cash CashBodyResponse `json:"cash"`
+	}
+	if code := do(t, h, "GET", "/cashes/"+created.UUID, auth, nil, &one); code != http.StatusOK || one.Cash.UUID.String() != created.UUID {
+		t.Errorf("get status %d, cash %+v", code, one.Cash)
+	}
+	if code := do(t, h, "GET", "/cashes/00000000-0000-0000-0000-000000000000", auth, nil, nil); code != http.StatusNotFound {
+		t.Errorf("get of missing cash status %d", code)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	denominations := gin.H{"client": "local", "currency": "USD", "values": []string{"1", "2"}}
+	if code := do(t, h, "PUT", "/denominations", auth, denominations, nil); code != http.StatusOK {
+		t.Fatalf("set denominations status %d", code)
+	}
+
+	cashes := []gin.H{
+		{"amount": "1.00", "currency": "TMT"},
+		{"amount": 1, "currency": "TMT"},
+		{"amount": "5", "currency": "TMT"},
+		{"amount": 0.5, "currency": "TMT"},
+		{"amount": "1.00", "currency": "USD"},
+	}
+	for _, cash := range cashes {
+		cash["api_key"], cash["contact"] = testAPIKey, "c"
+		if code := do(t, h, "POST", "/cashes", nil, cash, nil); code != http.StatusCreated {
+			t.Fatalf("create cash status %d", code)
+		}
+	}
+
+	var created struct {
+		UUID   string          `json:"uuid"`
+		Totals []CurrencyTotal `json:"totals"`
+	}
+	if code := do(t, h, "POST", "/ranges", nil, gin.H{"api_key": testAPIKey, "note": "shift 1"}, &created); code != http.StatusCreated {
+		t.Fatalf("create range status %d", code)
+	}
+	if code := do(t, h, "POST", "/ranges", nil, gin.H{"note": "shift 1"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("create range without api key status %d", code)
+	}
+
+	var list struct {
+		Ranges []RangeBodyResponse `json:"ranges"`
+		Total  int                 `json:"total"`
+	}
+	if code := do(t, h, "GET", "/ranges", auth, nil, &list); code != http.StatusOK {
+		t.Fatalf("list status %d", code)
+	}
+	if list.Total != 1 || len(list.Ranges) != 1 {
+		t.Fatalf("listed %d of %d ranges, want 1", len(list.Ranges), list.Total)
+	}
+	got := list.Ranges[0]
+	if got.UUID.String() != created.UUID || got.Note != "shift 1" || got.Client != "local" {
+		t.Errorf("listed range %+v", got)
+	}
+	totals := map[string]CurrencyTotal{}
+	for _, total := range got.Totals {
+		totals[total.Currency] = total
+	}
+	tmt, usd := totals["TMT"], totals["USD"]
+	if len(totals) != 2 || tmt.TotalAmount != 750 || usd.TotalAmount != 100 {
+		t.Errorf("range totals %+v", got.Totals)
+	}
+	// TMT has the default denominations, USD the client's own
+	if counts := denominationCounts(tmt); len(counts) != 6 || counts["1.00"] != 2 || counts["5.00"] != 1 || counts["10.00"] != 0 {
+		t.Errorf("range TMT denominations %v", counts)
+	}
+	if counts := denominationCounts(usd); len(counts) != 2 || counts["1.00"] != 1 || counts["2.00"] != 0 {
+		t.Errorf("range USD denominations %v", counts)
+	}
+	listed, _ := json.Marshal(got.Totals)
+	returned, _ := json.Marshal(created.Totals)
+	if !bytes.Equal(listed, returned) {
+		t.Errorf("listed totals %s, created %s", listed, returned)
+	}
+
+	// Totals are kept as they were when the range was created
+	denominations["values"] = []string{"5"}
+	if code := do(t, h, "PUT", "/denominations", auth, denominations, nil); code != http.StatusOK {
+		t.Fatalf("set denominations status %d", code)
+	}
+	if code := do(t, h, "GET", "/ranges", auth, nil, &list); code != http.StatusOK {
+		t.Fatalf("list status %d", code)
+	}
+	if settled, _ := json.Marshal(list.Ranges[0].Totals); !bytes.Equal(settled, returned) {
+		t.Errorf("totals after denominations change %s, created %s", settled, returned)
+	}
+}
+
+// denominationCounts returns count of the cashes by the denomination value
+func denominationCounts(total CurrencyTotal) map[string]uint {
+	counts := map[string]uint{}
+	for _, d := range total.Denominations {
+		counts[d.Value.String()] = d.Amount
+	}
+	return counts
+}
+
+func TestDenominations(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	var got DenominationsBody
+	if code := do(t, h, "GET", "/denominations?currency=tmt", auth, nil, &got); code != http.StatusOK {
+		t.Fatalf("get status %d", code)
+	}
+	if got.Currency != "TMT" || len(got.Values) != 6 || got.Values[0] != 100 {
+		t.Errorf("default denominations %+v", got)
+	}
+
+	// Values are sorted without duplicates
+	body := gin.H{"client": "local", "currency": "TMT", "values": []string{"5", "1.00", "1", "0.50"}}
+	if code := do(t, h, "PUT", "/denominations", auth, body, &got); code != http.StatusOK {
+		t.Fatalf("set status %d", code)
+	}
+	if code := do(t, h, "GET", "/denominations?currency=TMT&client=local", auth, nil, &got); code != http.StatusOK {
+		t.Fatalf("get status %d", code)
+	}
+	if len(got.Values) != 3 || got.Values[0] != 50 || got.Values[1] != 100 || got.Values[2] != 500 {
+		t.Errorf("client denominations %+v", got)
+	}
+	// Empty values bring back the defaults
+	if code := do(t, h, "PUT", "/denominations", auth, gin.H{"client": "local", "currency": "TMT"}, nil); code != http.StatusOK {
+		t.Fatalf("reset status %d", code)
+	}
+	if code := do(t, h, "GET", "/denominations?currency=TMT&client=local", auth, nil, &got); code != http.StatusOK || len(got.Values) != 6 {
+		t.Errorf("reset denominations %+v", got)
+	}
+
+	for name, body := range map[string]gin.H{
+		"zero value":       {"currency": "TMT", "values": []string{"0"}},
+		"unknown currency": {"currency": "XYZ", "values": []string{"1"}},
+		"fractional yen":   {"currency": "JPY", "values": []string{"1000", "0.50"}},
+		"without currency": {"values": []string{"1"}},
+	} {
+		if code := do(t, h, "PUT", "/denominations", auth, body, nil); code != http.StatusBadRequest {
+			t.Errorf("set %s status %d", name, code)
+		}
+	}
+	if code := do(t, h, "GET", "/denominations?currency=TMT", nil, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated status %d", code)
+	}
+}
+
+func TestRangesAssignCashes(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	createCash := func(amount string) string {
+		var created struct {
+			UUID string `json:"uuid"`
+		}
+		if code := do(t, h, "POST", "/cashes", nil, gin.H{"api_key": testAPIKey, "amount": amount, "contact": "c"}, &created); code != http.StatusCreated {
+			t.Fatalf("create cash status %d", code)
+		}
+		return created.UUID
+	}
+	createRange := func() (string, []CurrencyTotal) {
+		var created struct {
+			UUID   string          `json:"uuid"`
+			Totals []CurrencyTotal `json:"totals"`
+		}
+		if code := do(t, h, "POST", "/ranges", nil, gin.H{"api_key": testAPIKey}, &created); code != http.StatusCreated {
+			t.Fatalf("create range status %d", code)
+		}
+		return created.UUID, created.Totals
+	}
+
+	first := createCash("1")
+	firstRange, _ := createRange()
+	second := createCash("5")
+	secondRange, totals := createRange()
+	third := createCash("10")
+
+	// A range has only the cashes after the previous one
+	if len(totals) != 1 || totals[0].TotalAmount != 500 {
+		t.Errorf("second range totals %+v", totals)
+	}
+	if _, totals := createRange(); len(totals) != 1 || totals[0].TotalAmount != 1000 {
+		t.Errorf("third range totals %+v", totals)
+	}
+
+	var one struct {
+		Cash CashBodyResponse `json:"cash"`
+	}
+	for cash, want := range map[string]string{first: firstRange, second: secondRange} {
+		if code := do(t, h, "GET", "/cashes/"+cash, auth, nil, &one); code != http.StatusOK || one.Cash.RangeUUID == nil || one.Cash.RangeUUID.String() != want {
+			t.Errorf("cash %s status %d, range %v, want %s", cash, code, one.Cash.RangeUUID, want)
+		}
+	}
+
+	var list struct {
+		Cashes []CashBodyResponse `json:"cashes"`
+		Total  int                `json:"total"`
+	}
+	if code := do(t, h, "GET", "/cashes?range_uuid="+secondRange, auth, nil, &list); code != http.StatusOK || list.Total != 1 || list.Cashes[0].UUID.String() != second {
+		t.Errorf("range filter status %d, listed %+v", code, list.Cashes)
+	}
+	if code := do(t, h, "GET", "/cashes?uuid="+third, auth, nil, &list); code != http.StatusOK || list.Total != 1 || list.Cashes[0].RangeUUID == nil {
+		t.Errorf("cash of the third range status %d, listed %+v", code, list.Cashes)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	var first, second struct {
+		UUID string `json:"uuid"`
+	}
+	cash := gin.H{"api_key": testAPIKey, "amount": "1.00", "contact": "c"}
+	key := http.Header{"Idempotency-Key": {"terminal-1-note-1"}}
+	if code := do(t, h, "POST", "/cashes", key, cash, &first); code != http.StatusCreated {
+		t.Fatalf("create status %d", code)
+	}
+	// A retry returns the original cash
+	w := send(t, h, "POST", "/cashes", key, cash)
+	if err := json.Unmarshal(w.Body.Bytes(), &second); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("retry status %d: %v", w.Code, err)
+	}
+	if second.UUID != first.UUID || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry uuid %s, want %s, replayed %q", second.UUID, first.UUID, w.Header().Get("Idempotent-Replayed"))
+	}
+	// The body field is used without the header
+	cash["idempotency_key"] = "terminal-1-note-1"
+	if code := do(t, h, "POST", "/cashes", nil, cash, &second); code != http.StatusCreated || second.UUID != first.UUID {
+		t.Errorf("retry with body key status %d, uuid %s, want %s", code, second.UUID, first.UUID)
+	}
+	cash["idempotency_key"] = "terminal-1-note-2"
+	if code := do(t, h, "POST", "/cashes", nil, cash, &second); code != http.StatusCreated || second.UUID == first.UUID {
+		t.Errorf("other key status %d, uuid %s", code, second.UUID)
+	}
+	long := http.Header{"Idempotency-Key": {strings.Repeat("k", maxIdempotencyKeyLength+1)}}
+	if code := do(t, h, "POST", "/cashes", long, cash, nil); code != http.StatusBadRequest {
+		t.Errorf("long key status %d", code)
+	}
+
+	var list struct {
+		Total int `json:"total"`
+	}
+	if code := do(t, h, "GET", "/cashes", auth, nil, &list); code != http.StatusOK || list.Total != 2 {
+		t.Errorf("list status %d, %d cashes, want 2", code, list.Total)
+	}
+
+	var firstRange, secondRange struct {
+		UUID   string          `json:"uuid"`
+		Totals []CurrencyTotal `json:"totals"`
+	}
+	rangeBody := gin.H{"api_key": testAPIKey}
+	if code := do(t, h, "POST", "/ranges", key, rangeBody, &firstRange); code != http.StatusCreated {
+		t.Fatalf("create range status %d", code)
+	}
+	if code := do(t, h, "POST", "/ranges", key, rangeBody, &secondRange); code != http.StatusCreated || secondRange.UUID != firstRange.UUID {
+		t.Errorf("range retry status %d, uuid %s, want %s", code, secondRange.UUID, firstRange.UUID)
+	}
+	if len(secondRange.Totals) != 1 || secondRange.Totals[0].TotalAmount != 200 {
+		t.Errorf("range retry totals %+v", secondRange.Totals)
+	}
+
+	// Keys are forgotten after the retention window
+	h = testServer(t, func(cfg *config.Config) { cfg.IdempotencyKeyTTL = 0 })
+	if code := do(t, h, "POST", "/cashes", key, cash, &first); code != http.StatusCreated {
+		t.Fatalf("create status %d", code)
+	}
+	if code := do(t, h, "POST", "/cashes", key, cash, &second); code != http.StatusCreated || second.UUID == first.UUID {
+		t.Errorf("expired key status %d, uuid %s", code, second.UUID)
+	}
+}
+
+func TestCashBatch(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	var first struct {
+		UUID string `json:"uuid"`
+	}
+	key := http.Header{"Idempotency-Key": {"note-1"}}
+	cash := gin.H{"api_key": testAPIKey, "amount": "1.00", "contact": "c"}
+	if code := do(t, h, "POST", "/cashes", key, cash, &first); code != http.StatusCreated {
+		t.Fatalf("create status %d", code)
+	}
+
+	insertedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	batch := gin.H{"api_key": testAPIKey, "cashes": []gin.H{
+		{"amount": "5.00", "contact": "c", "idempotency_key": "note-2", "inserted_at": insertedAt},
+		{"amount": "1.00", "contact": "c", "idempotency_key": "note-1"},
+		{"amount": "0", "contact": "c"},
+		{"amount": "5.00", "contact": "c", "idempotency_key": "note-2"},
+		{"amount": "5.00"},
+		{"amount": "5.00", "contact": "c", "currency": "xx"},
+	}}
+	var result struct {
+		Results    []CashBatchResult `json:"results"`
+		Created    int               `json:"created"`
+		Duplicates int               `json:"duplicates"`
+		Rejected   int               `json:"rejected"`
+	}
+	if code := do(t, h, "POST", "/cashes/batch", nil, batch, &result); code != http.StatusOK {
+		t.Fatalf("batch status %d", code)
+	}
+	statuses := []string{CashBatchCreated, CashBatchDuplicate, CashBatchRejected, CashBatchDuplicate, CashBatchRejected, CashBatchRejected}
+	if len(result.Results) != len(statuses) {
+		t.Fatalf("batch results %+v", result.Results)
+	}
+	for i, want := range statuses {
+		r := result.Results[i]
+		if r.Index != i || r.Status != want || (want == CashBatchRejected) != (r.Error != "") || (want == CashBatchRejected) != (r.UUID == nil) {
+			t.Errorf("result %d = %+v, want status %s", i, r, want)
+		}
+	}
+	if result.Created != 1 || result.Duplicates != 2 || result.Rejected != 3 {
+		t.Errorf("batch counts %d, %d, %d", result.Created, result.Duplicates, result.Rejected)
+	}
+	if result.Results[1].UUID.String() != first.UUID || *result.Results[3].UUID != *result.Results[0].UUID {
+		t.Errorf("duplicates %+v, want the original cashes", result.Results)
+	}
+
+	var got struct {
+		Cash CashBodyResponse `json:"cash"`
+	}
+	if code := do(t, h, "GET", "/cashes/"+result.Results[0].UUID.String(), auth, nil, &got); code != http.StatusOK {
+		t.Fatalf("get status %d", code)
+	}
+	if got.Cash.InsertedAt == nil || !got.Cash.InsertedAt.Equal(insertedAt) || got.Cash.Amount != 5_00 {
+		t.Errorf("batch cash %+v", got.Cash)
+	}
+
+	var list struct {
+		Total int `json:"total"`
+	}
+	if code := do(t, h, "GET", "/cashes", auth, nil, &list); code != http.StatusOK || list.Total != 2 {
+		t.Errorf("list status %d, %d cashes, want 2", code, list.Total)
+	}
+
+	large := make([]gin.H, maxCashBatchSize+1)
+	for i := range large {
+		large[i] = gin.H{"amount": "1.00", "contact": "c"}
+	}
+	if code := do(t, h, "POST", "/cashes/batch", nil, gin.H{"api_key": testAPIKey, "cashes": large}, nil); code != http.StatusBadRequest {
+		t.Errorf("large batch status %d", code)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	createCash := func(insertedAt time.Time) string {
+		t.Helper()
+		var created struct {
+			UUID string `json:"uuid"`
+		}
+		cash := gin.H{"api_key": testAPIKey, "amount": "1.00", "contact": "c", "inserted_at": insertedAt}
+		if code := do(t, h, "POST", "/cashes", nil, cash, &created); code != http.StatusCreated {
+			t.Fatalf("create status %d", code)
+		}
+		return created.UUID
+	}
+	recent := createCash(now.Add(-time.Hour))
+	ahead := createCash(now.Add(time.Hour))
+	old := createCash(now.Add(-100 * time.Hour))
+
+	for id, want := range map[string]bool{recent: false, ahead: true, old: true} {
+		var got struct {
+			Cash CashBodyResponse `json:"cash"`
+		}
+		if code := do(t, h, "GET", "/cashes/"+id, auth, nil, &got); code != http.StatusOK {
+			t.Fatalf("get status %d", code)
+		}
+		if got.Cash.ClockSkewed != want {
+			t.Errorf("cash inserted at %s clock_skewed %v, want %v", got.Cash.InsertedAt, got.Cash.ClockSkewed, want)
+		}
+	}
+
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{old, ahead, recent}},
+		{"clock=device", []string{ahead, recent, old}},
+		{"clock=device&from=" + now.Add(-2*time.Hour).Format(time.RFC3339), []string{ahead, recent}},
+		{"clock=device&to=" + now.Format(time.RFC3339), []string{recent, old}},
+		{"from=" + now.Add(-time.Minute).Format(time.RFC3339), []string{old, ahead, recent}},
+		{"to=" + now.Add(-time.Minute).Format(time.RFC3339), nil},
+	} {
+		var list struct {
+			Cashes []CashBodyResponse `json:"cashes"`
+		}
+		if code := do(t, h, "GET", "/cashes?"+strings.ReplaceAll(test.query, "+", "%2B"), auth, nil, &list); code != http.StatusOK {
+			t.Fatalf("%s status %d", test.query, code)
+		}
+		var got []string
+		for _, c := range list.Cashes {
+			got = append(got, c.UUID.String())
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s cashes %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	for _, query := range []string{"clock=local", "from=yesterday"} {
+		if code := do(t, h, "GET", "/cashes?"+query, auth, nil, nil); code != http.StatusBadRequest {
+			t.Errorf("%s status %d", query, code)
+		}
+	}
+
+	h = testServer(t, func(cfg *config.Config) { cfg.Device.ClockSkewPolicy = config.ClockSkewReject })
+	cash := gin.H{"api_key": testAPIKey, "amount": "1.00", "contact": "c", "inserted_at": now.Add(time.Hour)}
+	if code := do(t, h, "POST", "/cashes", nil, cash, nil); code != http.StatusBadRequest {
+		t.Errorf("skewed cash with reject policy status %d", code)
+	}
+}
+
+func TestVoidCash(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	createCash := func(amount string) string {
+		t.Helper()
+		var created struct {
+			UUID string `json:"uuid"`
+		}
+		cash := gin.H{"api_key": testAPIKey, "amount": amount, "contact": "c", "currency": "USD"}
+		if code := do(t, h, "POST", "/cashes", nil, cash, &created); code != http.StatusCreated {
+			t.Fatalf("create status %d", code)
+		}
+		return created.UUID
+	}
+	kept := createCash("1.00")
+	voided := createCash("5.00")
+
+	reason := gin.H{"reason": "wrong note"}
+	for _, test := range []struct {
+		path   string
+		header http.Header
+		body   gin.H
+		want   int
+	}{
+		{"/cashes/" + voided + "/void", nil, reason, http.StatusUnauthorized},
+		{"/cashes/" + voided + "/void", auth, gin.H{"reason": " "}, http.StatusBadRequest},
+		{"/cashes/" + voided + "/void", auth, gin.H{}, http.StatusBadRequest},
+		{"/cashes/not-uuid/void", auth, reason, http.StatusBadRequest},
+		{"/cashes/" + uuid.NewString() + "/void", auth, reason, http.StatusNotFound},
+	} {
+		if code := do(t, h, "POST", test.path, test.header, test.body, nil); code != test.want {
+			t.Errorf("void %s with %v status %d, want %d", test.path, test.body, code, test.want)
+		}
+	}
+
+	var got struct {
+		Cash CashBodyResponse `json:"cash"`
+	}
+	if code := do(t, h, "POST", "/cashes/"+voided+"/void", auth, reason, &got); code != http.StatusOK {
+		t.Fatalf("void status %d", code)
+	}
+	if !got.Cash.Voided || got.Cash.Void == nil || got.Cash.Void.VoidedBy != "admin" || got.Cash.Void.Reason != "wrong note" {
+		t.Errorf("voided cash %+v", got.Cash)
+	}
+	if code := do(t, h, "POST", "/cashes/"+voided+"/void", auth, reason, nil); code != http.StatusConflict {
+		t.Errorf("void twice status %d, want %d", code, http.StatusConflict)
+	}
+
+	for query, want := range map[string]int{"": 1, "?include_voided=true": 2} {
+		var list struct {
+			Total int `json:"total"`
+		}
+		if code := do(t, h, "GET", "/cashes"+query, auth, nil, &list); code != http.StatusOK || list.Total != want {
+			t.Errorf("list%s status %d, %d cashes, want %d", query, code, list.Total, want)
+		}
+	}
+
+	var created struct {
+		Totals []CurrencyTotal `json:"totals"`
+	}
+	if code := do(t, h, "POST", "/ranges", nil, gin.H{"api_key": testAPIKey}, &created); code != http.StatusCreated {
+		t.Fatalf("create range status %d", code)
+	}
+	if len(created.Totals) != 1 || created.Totals[0].TotalAmount != 1_00 {
+		t.Errorf("range totals %+v, want only the kept cash", created.Totals)
+	}
+	if code := do(t, h, "POST", "/cashes/"+kept+"/void", auth, reason, nil); code != http.StatusConflict {
+		t.Errorf("void settled status %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	h := testServer(t)
+	if code := do(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "wrong"}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("bad login status %d", code)
+	}
+	auth := login(t, h)
+
+	var created struct {
+		UUID string `json:"uuid"`
+	}
+	cash := gin.H{"api_key": testAPIKey, "amount": "1.00", "contact": "c"}
+	if code := do(t, h, "POST", "/cashes", nil, cash, &created); code != http.StatusCreated {
+		t.Fatalf("create status %d", code)
+	}
+	batch := gin.H{"api_key": testAPIKey, "cashes": []gin.H{{"amount": "2.00", "contact": "c"}, {"amount": "3.00", "contact": "c"}}}
+	if code := do(t, h, "POST", "/cashes/batch", nil, batch, nil); code != http.StatusOK {
+		t.Fatalf("batch status %d", code)
+	}
+	if code := do(t, h, "POST", "/cashes/"+created.UUID+"/void", auth, gin.H{"reason": "wrong note"}, nil); code != http.StatusOK {
+		t.Fatalf("void status %d", code)
+	}
+
+	type events struct {
+		Events []AuditEventResponse `json:"events"`
+		Total  int                  `json:"total"`
+	}
+	var all events
+	if code := do(t, h, "GET", "/audit", auth, nil, &all); code != http.StatusOK {
+		t.Fatalf("audit status %d", code)
+	}
+	actions := []string{AuditCashVoid, AuditCashCreate, AuditCashCreate, AuditCashCreate, AuditLogin, AuditLoginFailed}
+	if all.Total != len(actions) || len(all.Events) != len(actions) {
+		t.Fatalf("audit events %+v", all.Events)
+	}
+	for i, action := range actions {
+		if all.Events[i].Action != action {
+			t.Errorf("event %d action %s, want %s", i, all.Events[i].Action, action)
+		}
+	}
+
+	void := all.Events[0]
+	if void.Actor != "user:admin" || void.Client != "local" || void.ResourceUUID == nil || void.ResourceUUID.String() != created.UUID {
+		t.Errorf("void event %+v", void)
+	}
+	var before, after CashBodyResponse
+	if err := json.Unmarshal(void.Before, &before); err != nil || before.Voided {
+		t.Errorf("void event before %s: %v", void.Before, err)
+	}
+	if err := json.Unmarshal(void.After, &after); err != nil || !after.Voided {
+		t.Errorf("void event after %s: %v", void.After, err)
+	}
+	if all.Events[1].ResourceUUID == nil || all.Events[2].ResourceUUID == nil || *all.Events[1].ResourceUUID == *all.Events[2].ResourceUUID {
+		t.Errorf("batch events %+v, %+v", all.Events[1], all.Events[2])
+	}
+	device := all.Events[3].Actor
+	if !strings.HasPrefix(device, "api_key:") || strings.Contains(device, testAPIKey) {
+		t.Errorf("device actor %s", device)
+	}
+
+	for _, test := range []struct {
+		query string
+		want  int
+	}{
+		{"?action=" + AuditCashCreate, 3},
+		{"?action=" + AuditLogin + "&action=" + AuditLoginFailed, 2},
+		{"?actor=user:admin", 3},
+		{"?actor=" + device + "&limit=1", 3},
+		{"?from=" + time.Now().Add(time.Minute).UTC().Format(time.RFC3339), 0},
+	} {
+		var filtered events
+		if code := do(t, h, "GET", "/audit"+test.query, auth, nil, &filtered); code != http.StatusOK || filtered.Total != test.want {
+			t.Errorf("audit%s status %d, %d events, want %d", test.query, code, filtered.Total, test.want)
+		}
+	}
+	if code := do(t, h, "GET", "/audit?to=today", auth, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("bad period status %d", code)
+	}
+	if code := do(t, h, "GET", "/audit", nil, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated status %d", code)
+	}
+}
+
+func TestClients(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	var got struct {
+		Client ClientResponse `json:"client"`
+	}
+	if code := do(t, h, "POST", "/clients", auth, gin.H{"name": "shop", "detail": "first shop"}, &got); code != http.StatusCreated || got.Client.Name != "shop" {
+		t.Fatalf("create status %d, client %+v", code, got.Client)
+	}
+	for _, test := range []struct {
+		body gin.H
+		want int
+	}{
+		{gin.H{"name": "shop"}, http.StatusConflict},
+		{gin.H{"detail": "no name"}, http.StatusBadRequest},
+		{gin.H{"name": strings.Repeat("n", 256)}, http.StatusBadRequest},
+	} {
+		if code := do(t, h, "POST", "/clients", auth, test.body, nil); code != test.want {
+			t.Errorf("create %v status %d, want %d", test.body, code, test.want)
+		}
+	}
+	if code := do(t, h, "POST", "/clients", nil, gin.H{"name": "other"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated create status %d", code)
+	}
+
+	var list struct {
+		Clients []ClientResponse `json:"clients"`
+		Total   int              `json:"total"`
+	}
+	if code := do(t, h, "GET", "/clients", auth, nil, &list); code != http.StatusOK || list.Total != 2 || list.Clients[0].Name != "local" || list.Clients[1].Name != "shop" {
+		t.Errorf("list status %d, clients %+v", code, list.Clients)
+	}
+	if code := do(t, h, "PUT", "/clients/shop", auth, gin.H{"detail": "main shop"}, &got); code != http.StatusOK || got.Client.Detail != "main shop" {
+		t.Errorf("update status %d, client %+v", code, got.Client)
+	}
+	if code := do(t, h, "GET", "/clients/shop", auth, nil, &got); code != http.StatusOK || got.Client.Detail != "main shop" {
+		t.Errorf("get status %d, client %+v", code, got.Client)
+	}
+	if code := do(t, h, "GET", "/clients/missing", auth, nil, nil); code != http.StatusNotFound {
+		t.Errorf("get missing status %d", code)
+	}
+
+	type createdKey struct {
+		APIKey string         `json:"api_key"`
+		Key    APIKeyResponse `json:"key"`
+	}
+	var first, second createdKey
+	if code := do(t, h, "POST", "/clients/shop/keys", auth, nil, &first); code != http.StatusCreated || first.APIKey == "" || !first.Key.Active {
+		t.Fatalf("create key status %d, key %+v", code, first)
+	}
+	if code := do(t, h, "POST", "/clients/shop/keys", auth, gin.H{"label": "till 2"}, &second); code != http.StatusCreated || second.Key.Label != "till 2" {
+		t.Fatalf("create labeled key status %d, key %+v", code, second)
+	}
+	if code := do(t, h, "POST", "/clients/missing/keys", auth, nil, nil); code != http.StatusNotFound {
+		t.Errorf("create key of missing client status %d", code)
+	}
+
+	createCash := func(apiKey string) int {
+		t.Helper()
+		return do(t, h, "POST", "/cashes", nil, gin.H{"api_key": apiKey, "amount": "1.00", "contact": "c"}, nil)
+	}
+	if code := createCash(first.APIKey); code != http.StatusCreated {
+		t.Errorf("cash with new key status %d", code)
+	}
+	var cashes struct {
+		Cashes []CashBodyResponse `json:"cashes"`
+	}
+	if code := do(t, h, "GET", "/cashes", auth, nil, &cashes); code != http.StatusOK || len(cashes.Cashes) != 1 || cashes.Cashes[0].Client != "shop" {
+		t.Errorf("list cashes status %d, cashes %+v", code, cashes.Cashes)
+	}
+
+	var revoked struct {
+		Key APIKeyResponse `json:"key"`
+	}
+	if code := do(t, h, "DELETE", "/clients/shop/keys/"+first.Key.UUID.String(), auth, nil, &revoked); code != http.StatusOK || revoked.Key.Active || revoked.Key.RevokedAt == nil {
+		t.Errorf("revoke status %d, key %+v", code, revoked.Key)
+	}
+	// The key used above is cached, the revocation applies right away anyway
+	if code := createCash(first.APIKey); code != http.StatusUnauthorized {
+		t.Errorf("cash with revoked key status %d", code)
+	}
+	if code := createCash(second.APIKey); code != http.StatusCreated {
+		t.Errorf("cash with other key status %d", code)
+	}
+	for _, path := range []string{"/clients/local/keys/" + second.Key.UUID.String(), "/clients/shop/keys/" + uuid.NewString()} {
+		if code := do(t, h, "DELETE", path, auth, nil, nil); code != http.StatusNotFound {
+			t.Errorf("revoke %s status %d", path, code)
+		}
+	}
+
+	var keys struct {
+		Keys []APIKeyResponse `json:"keys"`
+	}
+	if code := do(t, h, "GET", "/clients/shop/keys", auth, nil, &keys); code != http.StatusOK || len(keys.Keys) != 2 {
+		t.Fatalf("list keys status %d, keys %+v", code, keys.Keys)
+	}
+	for _, key := range keys.Keys {
+		if key.Active != (key.UUID == second.Key.UUID) || key.LastUsedAt == nil {
+			t.Errorf("key %+v", key)
+		}
+	}
+
+	if code := do(t, h, "DELETE", "/clients/shop", auth, nil, nil); code != http.StatusOK {
+		t.Errorf("delete status %d", code)
+	}
+	if code := createCash(second.APIKey); code != http.StatusUnauthorized {
+		t.Errorf("cash of deleted client status %d", code)
+	}
+	if code := do(t, h, "GET", "/clients/shop", auth, nil, nil); code != http.StatusNotFound {
+		t.Errorf("get deleted status %d", code)
+	}
+	if code := createCash(testAPIKey); code != http.StatusCreated {
+		t.Errorf("cash of other client status %d", code)
+	}
+}
+
+func TestDeviceAuth(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	var created struct {
+		APIKey string         `json:"api_key"`
+		Key    APIKeyResponse `json:"key"`
+	}
+	if code := do(t, h, "POST", "/clients/local/keys", auth, nil, &created); code != http.StatusCreated {
+		t.Fatalf("create key status %d", code)
+	}
+	if created.Key.Prefix == "" || !strings.HasPrefix(created.APIKey, created.Key.Prefix) || created.Key.Prefix == created.APIKey {
+		t.Errorf("key prefix %q of %q", created.Key.Prefix, created.APIKey)
+	}
+
+	cash := gin.H{"amount": "1.00", "contact": "c"}
+	for _, test := range []struct {
+		name       string
+		header     http.Header
+		body       gin.H
+		want       int
+		deprecated bool
+	}{
+		{"X-API-Key", http.Header{"X-Api-Key": {created.APIKey}}, cash, http.StatusCreated, false},
+		{"Authorization ApiKey", http.Header{"Authorization": {"ApiKey " + created.APIKey}}, cash, http.StatusCreated, false},
+		{"Authorization apikey", http.Header{"Authorization": {"apikey " + testAPIKey}}, cash, http.StatusCreated, false},
+		{"body field", nil, gin.H{"api_key": testAPIKey, "amount": "1.00", "contact": "c"}, http.StatusCreated, true},
+		{"header before body", http.Header{"X-Api-Key": {testAPIKey}}, gin.H{"api_key": "unknown", "amount": "1.00", "contact": "c"}, http.StatusCreated, false},
+		{"Bearer", http.Header{"Authorization": {"Bearer " + testAPIKey}}, cash, http.StatusUnauthorized, false},
+		{"unknown key", http.Header{"X-Api-Key": {"unknown"}}, cash, http.StatusUnauthorized, false},
+		{"same prefix", http.Header{"X-Api-Key": {created.Key.Prefix + "0"}}, cash, http.StatusUnauthorized, false},
+		{"no key", nil, cash, http.StatusUnauthorized, false},
+	} {
+		w := send(t, h, "POST", "/cashes", test.header, test.body)
+		if w.Code != test.want {
+			t.Errorf("%s status %d, want %d", test.name, w.Code, test.want)
+		}
+		if deprecated := w.Header().Get("Deprecation") == "true"; deprecated != test.deprecated {
+			t.Errorf("%s deprecation %v, want %v", test.name, deprecated, test.deprecated)
+		}
+	}
+
+	batch := gin.H{"cashes": []gin.H{cash}}
+	if code := do(t, h, "POST", "/cashes/batch", http.Header{"X-Api-Key": {created.APIKey}}, batch, nil); code != http.StatusOK {
+		t.Errorf("batch status %d", code)
+	}
+	if code := do(t, h, "POST", "/cashes/batch", nil, batch, nil); code != http.StatusUnauthorized {
+		t.Errorf("batch without key status %d", code)
+	}
+	if code := do(t, h, "POST", "/ranges", http.Header{"X-Api-Key": {created.APIKey}}, gin.H{}, nil); code != http.StatusCreated {
+		t.Errorf("range status %d", code)
+	}
+
+	var list struct {
+		Total int `json:"total"`
+	}
+	if code := do(t, h, "GET", "/cashes", auth, nil, &list); code != http.StatusOK || list.Total != 6 {
+		t.Errorf("list status %d, %d cashes, want 6", code, list.Total)
+	}
+}
+
+func TestSignatureAuth(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+	device := http.Header{"X-Api-Key": {testAPIKey}}
+	cash := gin.H{"amount": "1.00", "contact": "c"}
+
+	var secret struct {
+		SigningSecret string         `json:"signing_secret"`
+		Client        ClientResponse `json:"client"`
+	}
+	if code := do(t, h, "POST", "/cashes", device, cash, nil); code != http.StatusCreated {
+		t.Fatalf("unsigned status %d before signing is set up", code)
+	}
+	if code := do(t, h, "POST", "/clients/local/signing-secret", auth, gin.H{"required": true}, &secret); code != http.StatusCreated {
+		t.Fatalf("create secret status %d", code)
+	}
+	if secret.SigningSecret == "" || !secret.Client.SigningEnabled || !secret.Client.SignatureRequired {
+		t.Fatalf("signing secret %+v", secret)
+	}
+
+	// signed sends the body signed with HMAC-SHA256 over method, uri, timestamp, nonce and body hash
+	signed := func(signedURI, uri string, at time.Time, nonce string, signedBody, sentBody gin.H, transform func(string) string) (int, string) {
+		t.Helper()
+		body, err := json.Marshal(signedBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent := body
+		if sentBody != nil {
+			if sent, err = json.Marshal(sentBody); err != nil {
+				t.Fatal(err)
+			}
+		}
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		bodyHash := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, []byte(secret.SigningSecret))
+		mac.Write([]byte("POST\n" + signedURI + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+		signature := hex.EncodeToString(mac.Sum(nil))
+		if transform != nil {
+			signature = transform(signature)
+		}
+
+		req := httptest.NewRequest("POST", uri, bytes.NewReader(sent))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", testAPIKey)
+		req.Header.Set(SignatureHeader, signature)
+		req.Header.Set(SignatureTimestampHeader, timestamp)
+		req.Header.Set(SignatureNonceHeader, nonce)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var response struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Error
+	}
+
+	now := time.Now()
+	tampered := gin.H{"amount": "100.00", "contact": "c"}
+	for _, test := range []struct {
+		name      string
+		signedURI string
+		uri       string
+		at        time.Time
+		nonce     string
+		sent      gin.H
+		transform func(string) string
+		want      int
+		wantError string
+	}{
+		{"valid", "/cashes", "/cashes", now, "nonce-1", nil, nil, http.StatusCreated, ""},
+		{"replayed nonce", "/cashes", "/cashes", now, "nonce-1", nil, nil, http.StatusUnauthorized, "nonce_reused"},
+		{"upper case", "/cashes", "/cashes", now, "nonce-2", nil, strings.ToUpper, http.StatusCreated, ""},
+		{"tampered body", "/cashes", "/cashes", now, "nonce-3", tampered, nil, http.StatusUnauthorized, "signature_mismatch"},
+		{"mismatch keeps nonce", "/cashes", "/cashes", now, "nonce-3", nil, nil, http.StatusCreated, ""},
+		{"other signature", "/cashes", "/cashes", now, "nonce-4", nil, func(string) string { return strings.Repeat("0", 64) }, http.StatusUnauthorized, "signature_mismatch"},
+		{"stale timestamp", "/cashes", "/cashes", now.Add(-config.Default().Device.SignatureWindow - time.Minute), "nonce-5", nil, nil, http.StatusUnauthorized, "timestamp is outside of the signature window"},
+		{"future timestamp", "/cashes", "/cashes", now.Add(config.Default().Device.SignatureWindow + time.Minute), "nonce-6", nil, nil, http.StatusUnauthorized, "timestamp is outside of the signature window"},
+		{"no nonce", "/cashes", "/cashes", now, "", nil, nil, http.StatusUnauthorized, "nonce must have 1 to 255 characters"},
+		{"query", "/cashes?source=till", "/cashes?source=till", now, "nonce-7", nil, nil, http.StatusCreated, ""},
+		{"unsigned query", "/cashes", "/cashes?source=till", now, "nonce-8", nil, nil, http.StatusUnauthorized, "signature_mismatch"},
+	} {
+		code, errorCode := signed(test.signedURI, test.uri, test.at, test.nonce, cash, test.sent, test.transform)
+		if code != test.want || errorCode != test.wantError {
+			t.Errorf("%s status %d %q, want %d %q", test.name, code, errorCode, test.want, test.wantError)
+		}
+	}
+
+	var response struct {
+		Error string `json:"error"`
+	}
+	if code := do(t, h, "POST", "/cashes", device, cash, &response); code != http.StatusUnauthorized || response.Error != "signature_required" {
+		t.Errorf("unsigned status %d %q, want signature_required", code, response.Error)
+	}
+	if code := do(t, h, "POST", "/ranges", device, gin.H{}, &response); code != http.StatusUnauthorized || response.Error != "signature_required" {
+		t.Errorf("unsigned range status %d %q, want signature_required", code, response.Error)
+	}
+
+	if code := do(t, h, "DELETE", "/clients/local/signing-secret", auth, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete secret status %d", code)
+	}
+	if code := do(t, h, "POST", "/cashes", device, cash, nil); code != http.StatusCreated {
+		t.Errorf("unsigned status %d after signing is turned off", code)
+	}
+	if code, errorCode := signed("/cashes", "/cashes", now, "nonce-9", cash, nil, nil); code != http.StatusUnauthorized || errorCode != "signing_not_set_up" {
+		t.Errorf("signed status %d %q after signing is turned off", code, errorCode)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	userLogin := func(username, password string) (int, Tokens) {
+		t.Helper()
+		var tokens Tokens
+		code := do(t, h, "POST", "/login", nil, gin.H{"username": username, "password": password}, &tokens)
+		return code, tokens
+	}
+
+	var created struct {
+		User User `json:"user"`
+	}
+	if code := do(t, h, "POST", "/users", auth, gin.H{"username": "clerk", "password": "clerk-pass"}, &created); code != http.StatusCreated {
+		t.Fatalf("create status %d", code)
+	}
+	if created.User.Username != "clerk" || created.User.Password != "" {
+		t.Errorf("created user %+v", created.User)
+	}
+	for _, test := range []struct {
+		body gin.H
+		want int
+	}{
+		{gin.H{"username": "clerk", "password": "clerk-pass"}, http.StatusConflict},
+		{gin.H{"username": "short", "password": "short"}, http.StatusBadRequest},
+		{gin.H{"password": "clerk-pass"}, http.StatusBadRequest},
+	} {
+		if code := do(t, h, "POST", "/users", auth, test.body, nil); code != test.want {
+			t.Errorf("create %v status %d, want %d", test.body, code, test.want)
+		}
+	}
+	if code := do(t, h, "GET", "/users", nil, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated list status %d", code)
+	}
+
+	var list struct {
+		Users []map[string]interface{} `json:"users"`
+		Total int                      `json:"total"`
+	}
+	if code := do(t, h, "GET", "/users", auth, nil, &list); code != http.StatusOK || list.Total != 2 {
+		t.Fatalf("list status %d, users %+v", code, list.Users)
+	}
+	for _, user := range list.Users {
+		if _, ok := user["password"]; ok {
+			t.Errorf("listed user %v has password", user)
+		}
+	}
+
+	code, clerk := userLogin("clerk", "clerk-pass")
+	if code != http.StatusOK {
+		t.Fatalf("clerk login status %d", code)
+	}
+	clerkAuth := http.Header{"Authorization": {"Bearer " + clerk.AccessToken}}
+	if code := do(t, h, "GET", "/cashes", clerkAuth, nil, nil); code != http.StatusOK {
+		t.Fatalf("clerk list status %d", code)
+	}
+
+	if code := do(t, h, "POST", "/users/admin/disable", auth, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("self disable status %d", code)
+	}
+	if code := do(t, h, "DELETE", "/users/admin", auth, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("self delete status %d", code)
+	}
+
+	var disabled struct {
+		User User `json:"user"`
+	}
+	if code := do(t, h, "POST", "/users/clerk/disable", auth, nil, &disabled); code != http.StatusOK || disabled.User.DisabledAt == nil {
+		t.Fatalf("disable status %d, user %+v", code, disabled.User)
+	}
+	if code, _ := userLogin("clerk", "clerk-pass"); code != http.StatusForbidden {
+		t.Errorf("disabled login status %d", code)
+	}
+	if code := do(t, h, "POST", "/token", nil, gin.H{"refresh_token": clerk.RefreshToken}, nil); code != http.StatusForbidden {
+		t.Errorf("disabled refresh status %d", code)
+	}
+	// Issued access tokens stop working too
+	if code := do(t, h, "GET", "/cashes", clerkAuth, nil, nil); code != http.StatusForbidden {
+		t.Errorf("disabled access token status %d", code)
+	}
+	var enabled struct {
+		User User `json:"user"`
+	}
+	if code := do(t, h, "POST", "/users/clerk/enable", auth, nil, &enabled); code != http.StatusOK || enabled.User.DisabledAt != nil {
+		t.Errorf("enable status %d, user %+v", code, enabled.User)
+	}
+	if code, _ := userLogin("clerk", "clerk-pass"); code != http.StatusOK {
+		t.Errorf("enabled login status %d", code)
+	}
+
+	if code := do(t, h, "PUT", "/users/clerk/password", auth, gin.H{"password": "short"}, nil); code != http.StatusBadRequest {
+		t.Errorf("short reset status %d", code)
+	}
+	if code := do(t, h, "PUT", "/users/nobody/password", auth, gin.H{"password": "reset-pass"}, nil); code != http.StatusNotFound {
+		t.Errorf("reset of missing user status %d", code)
+	}
+	if code := do(t, h, "PUT", "/users/clerk/password", auth, gin.H{"password": "reset-pass"}, nil); code != http.StatusOK {
+		t.Errorf("reset status %d", code)
+	}
+	if code, _ := userLogin("clerk", "clerk-pass"); code != http.StatusUnauthorized {
+		t.Errorf("login with old password status %d", code)
+	}
+
+	for _, test := range []struct {
+		body gin.H
+		want int
+	}{
+		{gin.H{"current_password": "wrong-pass", "new_password": "changed-pass"}, http.StatusBadRequest},
+		{gin.H{"current_password": "reset-pass", "new_password": "short"}, http.StatusBadRequest},
+		{gin.H{"current_password": "reset-pass", "new_password": "changed-pass"}, http.StatusOK},
+	} {
+		if code := do(t, h, "PUT", "/me/password", clerkAuth, test.body, nil); code != test.want {
+			t.Errorf("change %v status %d, want %d", test.body, code, test.want)
+		}
+	}
+	if code, _ := userLogin("clerk", "changed-pass"); code != http.StatusOK {
+		t.Errorf("login with changed password status %d", code)
+	}
+
+	if code := do(t, h, "DELETE", "/users/clerk", auth, nil, nil); code != http.StatusOK {
+		t.Errorf("delete status %d", code)
+	}
+	if code := do(t, h, "DELETE", "/users/clerk", auth, nil, nil); code != http.StatusNotFound {
+		t.Errorf("delete twice status %d", code)
+	}
+	if code, _ := userLogin("clerk", "changed-pass"); code != http.StatusUnauthorized {
+		t.Errorf("deleted login status %d", code)
+	}
+	if code := do(t, h, "POST", "/token", nil, gin.H{"refresh_token": clerk.RefreshToken}, nil); code != http.StatusForbidden {
+		t.Errorf("deleted refresh status %d", code)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	var shop struct {
+		APIKey string `json:"api_key"`
+	}
+	if code := do(t, h, "POST", "/clients", auth, gin.H{"name": "shop"}, nil); code != http.StatusCreated {
+		t.Fatalf("create client status %d", code)
+	}
+	if code := do(t, h, "POST", "/clients/shop/keys", auth, nil, &shop); code != http.StatusCreated {
+		t.Fatalf("create key status %d", code)
+	}
+	createCash := func(apiKey string) string {
+		t.Helper()
+		var created struct {
+			UUID string `json:"uuid"`
+		}
+		cash := gin.H{"amount": "1.00", "contact": "c"}
+		if code := do(t, h, "POST", "/cashes", http.Header{"X-Api-Key": {apiKey}}, cash, &created); code != http.StatusCreated {
+			t.Fatalf("create cash status %d", code)
+		}
+		return created.UUID
+	}
+	localCash := createCash(testAPIKey)
+	shopCash := createCash(shop.APIKey)
+	for _, apiKey := range []string{testAPIKey, shop.APIKey} {
+		if code := do(t, h, "POST", "/ranges", http.Header{"X-Api-Key": {apiKey}}, gin.H{}, nil); code != http.StatusCreated {
+			t.Fatalf("create range status %d", code)
+		}
+	}
+	shopOpenCash := createCash(shop.APIKey)
+
+	for _, test := range []struct {
+		body gin.H
+		want int
+	}{
+		{gin.H{"username": "viewer", "password": "viewer-pass"}, http.StatusCreated},
+		{gin.H{"username": "accountant", "password": "accountant-pass", "role": RoleAccountant, "clients": []string{"shop"}}, http.StatusCreated},
+		{gin.H{"username": "owner", "password": "owner-pass", "role": "owner"}, http.StatusBadRequest},
+		{gin.H{"username": "scoped", "password": "scoped-pass", "clients": []string{"missing"}}, http.StatusBadRequest},
+	} {
+		if code := do(t, h, "POST", "/users", auth, test.body, nil); code != test.want {
+			t.Errorf("create %v status %d, want %d", test.body["username"], code, test.want)
+		}
+	}
+	userLogin := func(username, password string) (http.Header, Tokens) {
+		t.Helper()
+		var tokens Tokens
+		if code := do(t, h, "POST", "/login", nil, gin.H{"username": username, "password": password}, &tokens); code != http.StatusOK {
+			t.Fatalf("%s login status %d", username, code)
+		}
+		return http.Header{"Authorization": {"Bearer " + tokens.AccessToken}}, tokens
+	}
+	viewer, viewerTokens := userLogin("viewer", "viewer-pass")
+	accountant, _ := userLogin("accountant", "accountant-pass")
+
+	reason := gin.H{"reason": "wrong note"}
+	for _, test := range []struct {
+		name   string
+		header http.Header
+		method string
+		path   string
+		body   gin.H
+		want   int
+	}{
+		{"viewer list cashes", viewer, "GET", "/cashes", nil, http.StatusOK},
+		{"viewer list ranges", viewer, "GET", "/ranges", nil, http.StatusOK},
+		{"viewer void", viewer, "POST", "/cashes/" + shopOpenCash + "/void", reason, http.StatusForbidden},
+		{"viewer denominations", viewer, "GET", "/denominations?currency=TMT", nil, http.StatusForbidden},
+		{"viewer audit", viewer, "GET", "/audit", nil, http.StatusForbidden},
+		{"viewer users", viewer, "GET", "/users", nil, http.StatusForbidden},
+		{"viewer own password", viewer, "PUT", "/me/password", gin.H{"current_password": "viewer-pass", "new_password": "viewer-pass"}, http.StatusOK},
+		{"accountant other client cash", accountant, "GET", "/cashes/" + localCash, nil, http.StatusNotFound},
+		{"accountant own client cash", accountant, "GET", "/cashes/" + shopCash, nil, http.StatusOK},
+		{"accountant void other client", accountant, "POST", "/cashes/" + localCash + "/void", reason, http.StatusNotFound},
+		{"accountant void", accountant, "POST", "/cashes/" + shopOpenCash + "/void", reason, http.StatusOK},
+		{"accountant default denominations", accountant, "GET", "/denominations?currency=TMT", nil, http.StatusForbidden},
+		{"accountant other client denominations", accountant, "GET", "/denominations?currency=TMT&client=local", nil, http.StatusForbidden},
+		{"accountant own client denominations", accountant, "GET", "/denominations?currency=TMT&client=shop", nil, http.StatusOK},
+		{"accountant set other client denominations", accountant, "PUT", "/denominations", gin.H{"client": "local", "currency": "TMT", "values": []string{"1.00"}}, http.StatusForbidden},
+		{"accountant set denominations", accountant, "PUT", "/denominations", gin.H{"client": "shop", "currency": "TMT", "values": []string{"1.00"}}, http.StatusOK},
+		{"accountant audit", accountant, "GET", "/audit", nil, http.StatusOK},
+		{"accountant clients", accountant, "GET", "/clients", nil, http.StatusForbidden},
+	} {
+		if code := do(t, h, test.method, test.path, test.header, test.body, nil); code != test.want {
+			t.Errorf("%s status %d, want %d", test.name, code, test.want)
+		}
+	}
+
+	var cashes struct {
+		Cashes []CashBodyResponse `json:"cashes"`
+	}
+	if code := do(t, h, "GET", "/cashes?include_voided=true", accountant, nil, &cashes); code != http.StatusOK || len(cashes.Cashes) != 2 {
+		t.Errorf("accountant cashes status %d, cashes %+v", code, cashes.Cashes)
+	}
+	for _, c := range cashes.Cashes {
+		if c.Client != "shop" {
+			t.Errorf("accountant sees cash of %s", c.Client)
+		}
+	}
+	var ranges struct {
+		Ranges []RangeBodyResponse `json:"ranges"`
+	}
+	if code := do(t, h, "GET", "/ranges", accountant, nil, &ranges); code != http.StatusOK || len(ranges.Ranges) != 1 || ranges.Ranges[0].Client != "shop" {
+		t.Errorf("accountant ranges status %d, ranges %+v", code, ranges.Ranges)
+	}
+	var audit struct {
+		Events []AuditEventResponse `json:"events"`
+	}
+	if code := do(t, h, "GET", "/audit", accountant, nil, &audit); code != http.StatusOK || len(audit.Events) == 0 {
+		t.Errorf("accountant audit status %d, events %+v", code, audit.Events)
+	}
+	for _, e := range audit.Events {
+		if e.Client != "shop" {
+			t.Errorf("accountant sees audit event %s of client %q", e.Action, e.Client)
+		}
+	}
+
+	for _, test := range []struct {
+		body gin.H
+		want int
+	}{
+		{gin.H{"role": "owner"}, http.StatusBadRequest},
+		{gin.H{"role": RoleCollector, "clients": []string{"missing"}}, http.StatusBadRequest},
+		{gin.H{}, http.StatusBadRequest},
+	} {
+		if code := do(t, h, "PUT", "/users/viewer/role", auth, test.body, nil); code != test.want {
+			t.Errorf("set role %v status %d, want %d", test.body, code, test.want)
+		}
+	}
+	var changed struct {
+		User User `json:"user"`
+	}
+	if code := do(t, h, "PUT", "/users/viewer/role", auth, gin.H{"role": RoleCollector, "clients": []string{"local"}}, &changed); code != http.StatusOK {
+		t.Fatalf("set role status %d", code)
+	}
+	if changed.User.Role != RoleCollector || len(changed.User.Clients) != 1 || changed.User.Clients[0] != "local" {
+		t.Errorf("changed user %+v", changed.User)
+	}
+
+	// The role applies to the issued access tokens right away
+	if code := do(t, h, "GET", "/cashes/"+shopCash, viewer, nil, nil); code != http.StatusNotFound {
+		t.Errorf("changed role other client cash status %d", code)
+	}
+
+	// and to the refreshed ones, the password change has logged the viewer out
+	_, viewerTokens = userLogin("viewer", "viewer-pass")
+	var refreshed Tokens
+	if code := do(t, h, "POST", "/token", nil, gin.H{"refresh_token": viewerTokens.RefreshToken}, &refreshed); code != http.StatusOK {
+		t.Fatalf("refresh status %d", code)
+	}
+	collector := http.Header{"Authorization": {"Bearer " + refreshed.AccessToken}}
+	if code := do(t, h, "GET", "/denominations?currency=TMT&client=local", collector, nil, nil); code != http.StatusOK {
+		t.Errorf("collector denominations status %d", code)
+	}
+	if code := do(t, h, "GET", "/cashes/"+shopCash, collector, nil, nil); code != http.StatusNotFound {
+		t.Errorf("collector other client cash status %d", code)
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	h := testServer(t)
+
+	userLogin := func() Tokens {
+		t.Helper()
+		var tokens Tokens
+		if code := do(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "admin"}, &tokens); code != http.StatusOK {
+			t.Fatalf("login status %d", code)
+		}
+		return tokens
+	}
+	refresh := func(token string) (int, Tokens, string) {
+		t.Helper()
+		var response struct {
+			Tokens
+			Error string `json:"error"`
+		}
+		code := do(t, h, "POST", "/token", nil, gin.H{"refresh_token": token}, &response)
+		return code, response.Tokens, response.Error
+	}
+
+	first := userLogin()
+	code, second, _ := refresh(first.RefreshToken)
+	if code != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh status %d, tokens %+v", code, second)
+	}
+	auth := http.Header{"Authorization": {"Bearer " + second.AccessToken}}
+	if code := do(t, h, "GET", "/cashes", auth, nil, nil); code != http.StatusOK {
+		t.Errorf("refreshed access token status %d", code)
+	}
+
+	// Reuse of a rotated token revokes the whole family
+	if code, _, errorCode := refresh(first.RefreshToken); code != http.StatusUnauthorized || errorCode != "token_reused" {
+		t.Errorf("reused token status %d %q", code, errorCode)
+	}
+	if code, _, errorCode := refresh(second.RefreshToken); code != http.StatusUnauthorized || errorCode != "token_revoked" {
+		t.Errorf("token of the reused family status %d %q", code, errorCode)
+	}
+	var audit struct {
+		Total int `json:"total"`
+	}
+	if code := do(t, h, "GET", "/audit?action="+AuditTokenReused, auth, nil, &audit); code != http.StatusOK || audit.Total != 1 {
+		t.Errorf("audit status %d, %d reuse events", code, audit.Total)
+	}
+
+	// Other logins aren't affected by the revoked family
+	other := userLogin()
+	code, other, _ = refresh(other.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh of other login status %d", code)
+	}
+
+	if code, _, _ := refresh(first.AccessToken); code != http.StatusBadRequest {
+		t.Errorf("access token as refresh token status %d", code)
+	}
+	refreshAuth := http.Header{"Authorization": {"Bearer " + other.RefreshToken}}
+	if code := do(t, h, "GET", "/cashes", refreshAuth, nil, nil); code != http.StatusForbidden {
+		t.Errorf("refresh token as access token status %d", code)
+	}
+
+	if code := do(t, h, "POST", "/logout", nil, gin.H{"refresh_token": other.RefreshToken}, nil); code != http.StatusOK {
+		t.Errorf("logout status %d", code)
+	}
+	if code, _, errorCode := refresh(other.RefreshToken); code != http.StatusUnauthorized || errorCode != "token_revoked" {
+		t.Errorf("logged out token status %d %q", code, errorCode)
+	}
+
+	sessions := []Tokens{userLogin(), userLogin()}
+	auth = http.Header{"Authorization": {"Bearer " + sessions[0].AccessToken}}
+	if code := do(t, h, "POST", "/logout/all", auth, nil, nil); code != http.StatusOK {
+		t.Errorf("logout all status %d", code)
+	}
+	for i, session := range sessions {
+		if code, _, errorCode := refresh(session.RefreshToken); code != http.StatusUnauthorized || errorCode != "token_revoked" {
+			t.Errorf("session %d after logout all status %d %q", i, code, errorCode)
+		}
+	}
+	if code := do(t, h, "POST", "/logout/all", nil, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated logout all status %d", code)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	h := testServer(t)
+	tokens := login(t, h)
+
+	var set struct {
+		Keys []keyset.JWK `json:"keys"`
+	}
+	if code := do(t, h, "GET", "/.well-known/jwks.json", nil, nil, &set); code != http.StatusOK {
+		t.Fatalf("jwks status %d", code)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].Algorithm != "EdDSA" || set.Keys[0].X == "" {
+		t.Fatalf("jwks %+v", set.Keys)
+	}
+
+	token, _, err := new(jwt.Parser).ParseUnverified(strings.TrimPrefix(tokens.Get("Authorization"), "Bearer "), &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != set.Keys[0].ID || token.Method.Alg() != "EdDSA" {
+		t.Errorf("token header %v, want kid %s", token.Header, set.Keys[0].ID)
+	}
+
+	// Tokens signed with other keys are rejected
+	other, err := keyset.Ephemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := other.Sign(&Claims{User: User{Username: "admin", Role: RoleAdmin}, TokenType: TokenAccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := do(t, h, "GET", "/cashes", http.Header{"Authorization": {"Bearer " + forged}}, nil, nil); code != http.StatusForbidden {
+		t.Errorf("forged token status %d", code)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	wrong := gin.H{"username": "admin", "password": "wrong"}
+	right := gin.H{"username": "admin", "password": "admin"}
+	for i := 0; i < loginFreeFailures; i++ {
+		if code := do(t, h, "POST", "/login", nil, wrong, nil); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d status %d", i+1, code)
+		}
+	}
+	// Even the right password waits for the backoff
+	w := send(t, h, "POST", "/login", nil, right)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("login during the backoff status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if code := do(t, h, "POST", "/users/nobody/unlock", auth, nil, nil); code != http.StatusNotFound {
+		t.Errorf("unlock of missing user status %d", code)
+	}
+	if code := do(t, h, "POST", "/users/admin/unlock", auth, nil, nil); code != http.StatusOK {
+		t.Fatalf("unlock status %d", code)
+	}
+	if code := do(t, h, "POST", "/login", nil, right, nil); code != http.StatusOK {
+		t.Errorf("login after unlock status %d", code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	// Without the backoff only the lockout blocks, the rate limit allows all the tries
+	cfg := config.Default().Login
+	cfg.Backoff, cfg.MaxIPFailures, cfg.RateLimit = 0, cfg.MaxFailures+5, 0
+	h := testServer(t, func(c *config.Config) { c.Login = cfg })
+	auth := login(t, h)
+
+	for i := 0; i < cfg.MaxFailures; i++ {
+		if code := do(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "wrong"}, nil); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d status %d", i+1, code)
+		}
+	}
+	w := send(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "admin"})
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); w.Code != http.StatusTooManyRequests || retryAfter < int(cfg.Lockout.Seconds())-1 {
+		t.Errorf("locked login status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	var audit struct {
+		Total int `json:"total"`
+	}
+	if code := do(t, h, "GET", "/audit?action="+AuditLoginLocked, auth, nil, &audit); code != http.StatusOK || audit.Total != 1 {
+		t.Errorf("audit status %d, %d lock events", code, audit.Total)
+	}
+
+	// Other usernames are blocked once the IP reaches its limit
+	for i := 0; i < cfg.MaxIPFailures-cfg.MaxFailures; i++ {
+		if code := do(t, h, "POST", "/login", nil, gin.H{"username": "nobody-" + strconv.Itoa(i), "password": "wrong"}, nil); code != http.StatusUnauthorized {
+			t.Fatalf("failure of other username %d status %d", i+1, code)
+		}
+	}
+	if code := do(t, h, "POST", "/login", nil, gin.H{"username": "other", "password": "wrong"}, nil); code != http.StatusTooManyRequests {
+		t.Errorf("login from locked IP status %d", code)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+
+	var enrollment TOTPEnrollmentResponse
+	if code := do(t, h, "POST", "/me/2fa", auth, nil, &enrollment); code != http.StatusOK || enrollment.Secret == "" {
+		t.Fatalf("enroll status %d, %+v", code, enrollment)
+	}
+	if code := do(t, h, "POST", "/me/2fa/confirm", auth, gin.H{"code": "wrong"}, nil); code != http.StatusBadRequest {
+		t.Errorf("confirm with wrong code status %d", code)
+	}
+	code, err := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if status := do(t, h, "POST", "/me/2fa/confirm", auth, gin.H{"code": code}, &confirmed); status != http.StatusOK || len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("confirm status %d, %d recovery codes", status, len(confirmed.RecoveryCodes))
+	}
+
+	// The password alone gives a challenge only
+	var challenge struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+		AccessToken       string `json:"access_token"`
+	}
+	if status := do(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "admin"}, &challenge); status != http.StatusOK || !challenge.TwoFactorRequired || challenge.AccessToken != "" {
+		t.Fatalf("login status %d, %+v", status, challenge)
+	}
+	if status := do(t, h, "POST", "/logout/all", http.Header{"Authorization": {"Bearer " + challenge.ChallengeToken}}, nil, nil); status != http.StatusForbidden {
+		t.Errorf("challenge token as access token status %d", status)
+	}
+
+	// The code confirming the secret is used already
+	if status := do(t, h, "POST", "/login/2fa", nil, gin.H{"challenge_token": challenge.ChallengeToken, "code": code}, nil); status != http.StatusUnauthorized {
+		t.Errorf("login with used code status %d", status)
+	}
+	var tokens Tokens
+	recovery := gin.H{"challenge_token": challenge.ChallengeToken, "code": strings.ToLower(confirmed.RecoveryCodes[0])}
+	if status := do(t, h, "POST", "/login/2fa", nil, recovery, &tokens); status != http.StatusOK || tokens.AccessToken == "" {
+		t.Fatalf("login with recovery code status %d", status)
+	}
+	var failed struct {
+		Error string `json:"error"`
+	}
+	replayed := gin.H{"challenge_token": challenge.ChallengeToken, "code": confirmed.RecoveryCodes[2]}
+	if status := do(t, h, "POST", "/login/2fa", nil, replayed, &failed); status != http.StatusUnauthorized || failed.Error != "challenge_used" {
+		t.Errorf("login with used challenge status %d, error %s", status, failed.Error)
+	}
+	if status := do(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "admin"}, &challenge); status != http.StatusOK {
+		t.Fatalf("login status %d", status)
+	}
+	recovery["challenge_token"] = challenge.ChallengeToken
+	if status := do(t, h, "POST", "/login/2fa", nil, recovery, nil); status != http.StatusUnauthorized {
+		t.Errorf("login with used recovery code status %d", status)
+	}
+
+	// Required roles can't disable it
+	if status := do(t, h, "PUT", "/policies/2fa", auth, gin.H{"roles": []string{RoleAdmin}}, nil); status != http.StatusOK {
+		t.Fatalf("set policy status %d", status)
+	}
+	if status := do(t, h, "POST", "/me/2fa/disable", auth, gin.H{"code": confirmed.RecoveryCodes[1]}, nil); status != http.StatusForbidden {
+		t.Errorf("disable of required two-factor status %d", status)
+	}
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	h := testServer(t)
+	auth := login(t, h)
+	if code := do(t, h, "PUT", "/policies/2fa", auth, gin.H{"roles": []string{RoleAdmin}}, nil); code != http.StatusOK {
+		t.Fatalf("set policy status %d", code)
+	}
+
+	var challenge struct {
+		EnrollmentRequired bool   `json:"enrollment_required"`
+		ChallengeToken     string `json:"challenge_token"`
+	}
+	if code := do(t, h, "POST", "/login", nil, gin.H{"username": "admin", "password": "admin"}, &challenge); code != http.StatusOK || !challenge.EnrollmentRequired {
+		t.Fatalf("login status %d, %+v", code, challenge)
+	}
+	if code := do(t, h, "POST", "/login/2fa", nil, gin.H{"challenge_token": challenge.ChallengeToken, "code": "123456"}, nil); code != http.StatusBadRequest {
+		t.Errorf("login before enrollment status %d", code)
+	}
+	if code := do(t, h, "POST", "/login/2fa/enroll", nil, gin.H{"challenge_token": auth.Get("Authorization")[len("Bearer "):]}, nil); code != http.StatusUnauthorized {
+		t.Errorf("enroll with access token status %d", code)
+	}
+
+	var enrollment TOTPEnrollmentResponse
+	if code := do(t, h, "POST", "/login/2fa/enroll", nil, gin.H{"challenge_token": challenge.ChallengeToken}, &enrollment); code != http.StatusOK {
+		t.Fatalf("enroll status %d", code)
+	}
+	// The challenge doesn't replace the pending secret again
+	if code := do(t, h, "POST", "/login/2fa/enroll", nil, gin.H{"challenge_token": challenge.ChallengeToken}, nil); code != http.StatusUnauthorized {
+		t.Errorf("second enroll status %d", code)
+	}
+	code, err := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session struct {
+		AccessToken   string   `json:"access_token"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if status := do(t, h, "POST", "/login/2fa", nil, gin.H{"challenge_token": challenge.ChallengeToken, "code": code}, &session); status != http.StatusOK || session.AccessToken == "" || len(session.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("login with enrollment status %d, %d recovery codes", status, len(session.RecoveryCodes))
+	}
+}
+
+func TestTwoFactorEnrollmentRateLimit(t *testing.T) {
+	h := testServer(t, func(c *config.Config) { c.Login.RateBurst = 2 })
+	for i := 0; i < 2; i++ {
+		if code := do(t, h, "POST", "/login/2fa/enroll", nil, gin.H{"challenge_token": "invalid"}, nil); code != http.StatusUnauthorized {
+			t.Fatalf("enroll %d status %d", i+1, code)
+		}
+	}
+	if code := do(t, h, "POST", "/login/2fa/enroll", nil, gin.H{"challenge_token": "invalid"}, nil); code != http.StatusTooManyRequests {
+		t.Errorf("limited enroll status %d", code)
+	}
+}
+
+func TestDeviceRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Router()
+	auth := login(t, h)
+	device := http.Header{"X-Api-Key": {testAPIKey}}
+
+	if code := do(t, h, "PUT", "/clients/local/limits", auth, gin.H{"rate_limit": 0.001, "rate_burst": 2}, nil); code != http.StatusOK {
+		t.Fatalf("set limits status %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := do(t, h, "POST", "/ranges", device, gin.H{}, nil); code != http.StatusCreated {
+			t.Fatalf("request %d status %d", i+1, code)
+		}
+	}
+	w := send(t, h, "POST", "/ranges", device, gin.H{})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("limited request status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// The requests are saved in batches
+	if err := s.FlushUsage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var usage struct {
+		Usage     []APIKeyUsageResponse `json:"usage"`
+		RateBurst int                   `json:"rate_burst"`
+	}
+	if code := do(t, h, "GET", "/clients/local/usage", auth, nil, &usage); code != http.StatusOK || usage.RateBurst != 2 {
+		t.Fatalf("usage status %d, burst %d", code, usage.RateBurst)
+	}
+	if len(usage.Usage) != 1 || usage.Usage[0].Requests != 2 {
+		t.Errorf("usage %+v", usage.Usage)
+	}
+
+	// Zero rate disables the limit, the quota still applies
+	if code := do(t, h, "PUT", "/clients/local/limits", auth, gin.H{"rate_limit": 0, "daily_quota": 3}, nil); code != http.StatusOK {
+		t.Fatalf("set limits status %d", code)
+	}
+	// Requests with invalid signatures don't use up the quota
+	if code := do(t, h, "POST", "/clients/local/signing-secret", auth, gin.H{"required": true}, nil); code != http.StatusCreated {
+		t.Fatalf("create secret status %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := do(t, h, "POST", "/ranges", device, gin.H{}, nil); code != http.StatusUnauthorized {
+			t.Fatalf("unsigned request status %d", code)
+		}
+	}
+	if code := do(t, h, "DELETE", "/clients/local/signing-secret", auth, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete secret status %d", code)
+	}
+	if code := do(t, h, "POST", "/ranges", device, gin.H{}, nil); code != http.StatusCreated {
+		t.Errorf("request under the quota status %d", code)
+	}
+	var failed struct {
+		Error string `json:"error"`
+	}
+	if code := do(t, h, "POST", "/ranges", device, gin.H{}, &failed); code != http.StatusTooManyRequests || failed.Error != "quota_exceeded" {
+		t.Errorf("request over the quota status %d, error %s", code, failed.Error)
+	}
+	// Requests over the quota aren't counted
+	if code := do(t, h, "POST", "/ranges", device, gin.H{}, nil); code != http.StatusTooManyRequests {
+		t.Errorf("second request over the quota status %d", code)
+	}
+	if err := s.FlushUsage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := do(t, h, "GET", "/clients/local/usage", auth, nil, &usage); code != http.StatusOK {
+		t.Fatalf("usage status %d", code)
+	}
+	if len(usage.Usage) != 1 || usage.Usage[0].Requests != 3 {
+		t.Errorf("usage %+v, want the quota of 3 requests", usage.Usage)
+	}
+}
+
+func TestFlushUsageEvery(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) { c.Device.UsageFlushInterval = 10 * time.Millisecond })
+	h := s.Router()
+	if code := do(t, h, "POST", "/ranges", http.Header{"X-Api-Key": {testAPIKey}}, gin.H{}, nil); code != http.StatusCreated {
+		t.Fatalf("request status %d", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.FlushUsageEvery(ctx)
+		close(done)
+	}()
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		usages, err := s.store.ListAPIKeyUsage(context.Background(), "local", day, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(usages) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("usage isn't flushed")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("flush loop doesn't stop after the cancel")
+	}
+}
+
+func TestAPIKeyCache(t *testing.T) {
+	now := time.Now()
+	cache := newAPIKeyCache(time.Minute)
+	apiKey := store.APIKey{UUID: uuid.New(), Client: "local"}
+	cache.put("hash", apiKey, store.Client{Name: "local"}, now)
+
+	if entry, ok := cache.get("hash", now.Add(time.Minute)); !ok || entry.apiKey.UUID != apiKey.UUID {
+		t.Errorf("cached key %+v, %t", entry, ok)
+	}
+	if _, ok := cache.get("hash", now.Add(time.Minute+time.Second)); ok {
+		t.Error("expired key is cached")
+	}
+	cache.put("hash", apiKey, store.Client{Name: "local"}, now)
+	cache.purge()
+	if _, ok := cache.get("hash", now); ok {
+		t.Error("purged key is cached")
+	}
+
+	// Zero ttl disables the cache
+	disabled := newAPIKeyCache(0)
+	disabled.put("hash", apiKey, store.Client{Name: "local"}, now)
+	if _, ok := disabled.get("hash", now); ok {
+		t.Error("key is cached without ttl")
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	h := testServer(t, func(cfg *config.Config) { cfg.HTTP.MaxBodyBytes = 4 << 10 })
+	device := http.Header{"X-Api-Key": {testAPIKey}}
+
+	if code := do(t, h, "POST", "/ranges", device, gin.H{"note": strings.Repeat("n", 1<<10)}, nil); code != http.StatusCreated {
+		t.Errorf("small body status %d", code)
+	}
+	var failed struct {
+		Error string `json:"error"`
+	}
+	if code := do(t, h, "POST", "/ranges", device, gin.H{"note": strings.Repeat("n", 8<<10)}, &failed); code != http.StatusRequestEntityTooLarge || failed.Error != "body_too_large" {
+		t.Errorf("large body status %d, error %s", code, failed.Error)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	// Without the backoff an IP is blocked after its failures only
+	login := config.Default().Login
+	login.Backoff, login.MaxIPFailures, login.RateLimit = 0, login.MaxFailures, 0
+	loginFrom := func(h http.Handler, forwardedFor, username string) int {
+		t.Helper()
+		return do(t, h, "POST", "/login", http.Header{"X-Forwarded-For": {forwardedFor}}, gin.H{"username": username, "password": "wrong"}, nil)
+	}
+	blockIP := func(h http.Handler, forwardedFor string) {
+		t.Helper()
+		for i := 0; i < login.MaxIPFailures; i++ {
+			loginFrom(h, forwardedFor, "nobody-"+strconv.Itoa(i))
+		}
+		if code := loginFrom(h, forwardedFor, "other"); code != http.StatusTooManyRequests {
+			t.Fatalf("blocked IP status %d", code)
+		}
+	}
+
+	// X-Forwarded-For of an untrusted client doesn't choose the IP
+	h := testServer(t, func(cfg *config.Config) { cfg.Login = login })
+	blockIP(h, "198.51.100.1")
+	if code := loginFrom(h, "198.51.100.2", "other"); code != http.StatusTooManyRequests {
+		t.Errorf("other forwarded IP status %d", code)
+	}
+
+	h = testServer(t, func(cfg *config.Config) {
+		cfg.Login = login
+		cfg.HTTP.TrustedProxies = []string{"192.0.2.0/24"}
+	})
+	blockIP(h, "198.51.100.1")
+	if code := loginFrom(h, "198.51.100.2", "other"); code != http.StatusUnauthorized {
+		t.Errorf("other IP behind the trusted proxy status %d", code)
+	}
+}
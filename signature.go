@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gocash/pkg/logger"
+	"gocash/pkg/store"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers of signed requests
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+)
+
+// maxNonceLength is the size of request_nonces.nonce column
+const maxNonceLength = 255
+
+// SignaturePayload is the string a device signs with HMAC-SHA256 of the client's secret:
+// method, path with query, unix timestamp, nonce and hex sha256 of the body, separated by new lines
+func SignaturePayload(method, path, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{method, path, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")
+}
+
+// Sign returns hex encoded HMAC-SHA256 of the payload
+func Sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureAuth verifies signed requests of the device authenticated by DeviceAuth.
+// Unsigned requests pass unless the client requires signatures. Timestamp must be within
+// device.signature_window of the server time and a nonce can't be used twice in the window
+func (s *Server) SignatureAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := CurrentClient(c)
+
+		signature := c.GetHeader(SignatureHeader)
+		if signature == "" {
+			if client.SignatureRequired {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error":   "signature_required",
+					"message": "Request must be signed",
+				})
+				return
+			}
+			c.Next()
+			return
+		}
+		if client.SigningSecret == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error":   "signing_not_set_up",
+				"message": "Client has no signing secret",
+			})
+			return
+		}
+
+		timestamp := c.GetHeader(SignatureTimestampHeader)
+		nonce := c.GetHeader(SignatureNonceHeader)
+		signedAt, err := checkSignatureHeaders(timestamp, nonce, s.config.Device.SignatureWindow)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error":   err.Error(),
+				"message": "Signature invalid",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"message": "Couldn't read the request body",
+			})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		expected := Sign(client.SigningSecret, SignaturePayload(c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body))
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error":   "signature_mismatch",
+				"message": "Signature invalid",
+			})
+			return
+		}
+
+		// Nonce is claimed only for valid signatures, so it can't be burned by others
+		if err := s.store.ClaimNonce(c, client.Name, nonce, signedAt.Add(s.config.Device.SignatureWindow)); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, store.ErrConflict) {
+				status = http.StatusUnauthorized
+				err = errors.New("nonce_reused")
+			} else {
+				logger.Errorf("nonce save error %v", err)
+			}
+			c.AbortWithStatusJSON(status, gin.H{
+				"error":   err.Error(),
+				"message": "Signature invalid",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkSignatureHeaders validates nonce and returns the time of the timestamp
+// if it's within the window of the server time
+func checkSignatureHeaders(timestamp, nonce string, window time.Duration) (time.Time, error) {
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return time.Time{}, fmt.Errorf("nonce must have 1 to %d characters", maxNonceLength)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timestamp must be unix seconds: %w", err)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > window || skew < -window {
+		return time.Time{}, errors.New("timestamp is outside of the signature window")
+	}
+	return signedAt, nil
+}
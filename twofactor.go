@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"gocash/pkg/arrs"
+	"gocash/pkg/logger"
+	"gocash/pkg/store"
+	"gocash/pkg/totp"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+// totpIssuer is shown by the authenticator apps next to the username
+const totpIssuer = "gocash"
+
+// challengeTimeout is how long the second step of the login may take
+const challengeTimeout = 5 * time.Minute
+
+// recoveryCodeCount is count of recovery codes generated at once, each code logs in once
+const recoveryCodeCount = 10
+
+// CodeBody carries a TOTP code or a recovery code
+type CodeBody struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ChallengeBody is the second step of the login of users with two-factor authentication
+type ChallengeBody struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code"`
+}
+
+// TwoFactorRolesBody replaces roles required to use two-factor authentication
+type TwoFactorRolesBody struct {
+	Roles []string `json:"roles"`
+}
+
+// TOTPEnrollmentResponse is the pending secret, otpauth_uri is shown as a QR code
+type TOTPEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// generateRecoveryCodes returns codes like ABCD-EFGH and their hashes
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(b)
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns hex encoded sha256 hash of the code ignoring case and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// twoFactorRequired reports whether the role of the user has to use two-factor authentication
+func (s *Server) twoFactorRequired(ctx context.Context, user store.User) (bool, error) {
+	roles, err := s.store.TwoFactorRoles(ctx)
+	if err != nil {
+		return false, err
+	}
+	return arrs.Contains(roles, user.Role), nil
+}
+
+// checkSecondFactor accepts a TOTP code of the enabled secret or an unused recovery code.
+// Each TOTP code is accepted once
+func (s *Server) checkSecondFactor(ctx context.Context, user store.User, code string) (bool, error) {
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		err := s.store.UseTOTPStep(ctx, user.Username, step)
+		if errors.Is(err, store.ErrConflict) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	err := s.store.UseRecoveryCode(ctx, user.Username, hashRecoveryCode(code), time.Now())
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// loginChallenge responds with a short lived token exchanged for the tokens at /login/2fa
+func (s *Server) loginChallenge(ctx *gin.Context, user store.User) {
+	challenge, err := s.signToken(&Claims{
+		User:      User{Username: user.Username},
+		TokenType: TokenChallenge,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(challengeTimeout)),
+		},
+	})
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Coulnd't create token",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"two_factor_required": true,
+		"enrollment_required": user.TOTPEnabledAt == nil,
+		"challenge_token":     challenge,
+	})
+}
+
+// challengeUser validates the challenge token and returns its claims and active user, responds on failure
+func (s *Server) challengeUser(ctx *gin.Context, challengeToken string) (store.User, *Claims, bool) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(challengeToken, claims, s.keys.Keyfunc)
+	if err == nil && claims.TokenType != TokenChallenge {
+		err = errors.New("token is not a challenge token")
+	}
+	if err == nil {
+		_, err = uuid.Parse(claims.ID)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"error":   err.Error(),
+			"message": "Challenge token is invalid, log in again",
+		})
+		return store.User{}, nil, false
+	}
+
+	user, err := s.store.UserByUsername(ctx, claims.User.Username)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		storeError(ctx, err, "Couldn't find user")
+		return store.User{}, nil, false
+	}
+	if err != nil || user.DisabledAt != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":   "user_disabled",
+			"message": "User is disabled",
+		})
+		return store.User{}, nil, false
+	}
+	return user, claims, true
+}
+
+// enrollNamespace derives IDs of the enrollment uses of challenge tokens, so a token used
+// to start the enrollment still finishes the login once
+var enrollNamespace = uuid.MustParse("5c3b7a52-4f0e-4d7c-9a43-0d1f6a8e2b91")
+
+// useChallenge marks the challenge token exchanged, so it can't be replayed. Responds on failure
+func (s *Server) useChallenge(ctx *gin.Context, claims *Claims) bool {
+	return s.claimChallenge(ctx, uuid.MustParse(claims.ID), claims)
+}
+
+// useEnrollChallenge marks the challenge token used to start the enrollment,
+// so one login doesn't replace the pending secret again. Responds on failure
+func (s *Server) useEnrollChallenge(ctx *gin.Context, claims *Claims) bool {
+	return s.claimChallenge(ctx, uuid.NewSHA1(enrollNamespace, []byte(claims.ID)), claims)
+}
+
+func (s *Server) claimChallenge(ctx *gin.Context, id uuid.UUID, claims *Claims) bool {
+	err := s.store.UseChallenge(ctx, id, claims.ExpiresAt.Time)
+	if errors.Is(err, store.ErrConflict) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "challenge_used",
+			"message": "Challenge token has been used, log in again",
+		})
+		return false
+	}
+	if err != nil {
+		storeError(ctx, err, "Couldn't use the challenge token")
+		return false
+	}
+	return true
+}
+
+// loginTwoFactor exchanges the challenge token and a TOTP or recovery code for the tokens.
+// Users required to use two-factor authentication without it confirm the secret
+// of /login/2fa/enroll here and get their recovery codes
+func (s *Server) loginTwoFactor(ctx *gin.Context) {
+	var body ChallengeBody
+	if err := ctx.BindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	user, claims, ok := s.challengeUser(ctx, body.ChallengeToken)
+	if !ok {
+		return
+	}
+
+	// Codes are guessed slower than passwords but still counted
+	retryAt, err := s.loginBlockedUntil(ctx, user.Username)
+	if err != nil {
+		storeError(ctx, err, "Couldn't check failed logins")
+		return
+	}
+	if retryAt.After(time.Now()) {
+		tooManyLogins(ctx, retryAt)
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		ok, err := s.checkSecondFactor(ctx, user, body.Code)
+		if err != nil {
+			storeError(ctx, err, "Couldn't check the code")
+			return
+		}
+		if !ok {
+			s.loginFailed(ctx, user.Username, loginWrongCode)
+			return
+		}
+		if s.useChallenge(ctx, claims) {
+			s.startSession(ctx, user, gin.H{})
+		}
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "two_factor_not_enrolled",
+			"message": "Two-factor authentication is required, enroll at /login/2fa/enroll first",
+		})
+		return
+	}
+	if _, ok := totp.Validate(user.TOTPSecret, body.Code, time.Now()); !ok {
+		s.loginFailed(ctx, user.Username, loginWrongCode)
+		return
+	}
+	if !s.useChallenge(ctx, claims) {
+		return
+	}
+	codes, ok := s.enableTOTP(ctx, user, body.Code)
+	if !ok {
+		return
+	}
+	s.startSession(ctx, user, gin.H{"recovery_codes": codes})
+}
+
+// enrollLogin starts enrollment of the user required to use two-factor authentication
+func (s *Server) enrollLogin(ctx *gin.Context) {
+	var body ChallengeBody
+	if err := ctx.BindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	user, claims, ok := s.challengeUser(ctx, body.ChallengeToken)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabledAt == nil && !s.useEnrollChallenge(ctx, claims) {
+		return
+	}
+	s.startTOTPEnrollment(ctx, user)
+}
+
+// startTOTPEnrollment saves a pending secret of the user without enabled two-factor authentication
+func (s *Server) startTOTPEnrollment(ctx *gin.Context, user store.User) {
+	if user.TOTPEnabledAt != nil {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":   "two_factor_enabled",
+			"message": "Two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't generate the secret",
+		})
+		return
+	}
+	if err := s.store.SetTOTPSecret(ctx, user.Username, secret, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't save the secret")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, TOTPEnrollmentResponse{
+		Secret: secret,
+		URI:    totp.URI(totpIssuer, user.Username, secret),
+	})
+}
+
+// enableTOTP confirms the pending secret by the code and returns new recovery codes, responds on failure
+func (s *Server) enableTOTP(ctx *gin.Context, user store.User, code string) ([]string, bool) {
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "wrong_code",
+			"message": "Invalid code",
+		})
+		return nil, false
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't generate recovery codes",
+		})
+		return nil, false
+	}
+	if err := s.store.EnableTOTP(ctx, user.Username, step, hashes, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't enable two-factor authentication")
+		return nil, false
+	}
+
+	s.audit(ctx, AuditEntry{Action: AuditTwoFactorEnable, Actor: userActor(user.Username)})
+	return codes, true
+}
+
+// currentUser returns the stored user of the access token, responds on failure
+func (s *Server) currentUser(ctx *gin.Context) (store.User, bool) {
+	user, err := s.store.UserByUsername(ctx, CurrentClaims(ctx).User.Username)
+	if err != nil {
+		storeError(ctx, err, "Couldn't find user")
+		return store.User{}, false
+	}
+	return user, true
+}
+
+func (s *Server) enrollTwoFactor(ctx *gin.Context) {
+	user, ok := s.currentUser(ctx)
+	if !ok {
+		return
+	}
+	s.startTOTPEnrollment(ctx, user)
+}
+
+func (s *Server) confirmTwoFactor(ctx *gin.Context) {
+	var body CodeBody
+	if err := ctx.BindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	user, ok := s.currentUser(ctx)
+	if !ok {
+		return
+	}
+	if user.TOTPSecret == "" || user.TOTPEnabledAt != nil {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":   "no_pending_enrollment",
+			"message": "Start the enrollment at POST /me/2fa first",
+		})
+		return
+	}
+
+	codes, ok := s.enableTOTP(ctx, user, body.Code)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"recovery_codes": codes,
+	})
+}
+
+// checkCurrentCode checks the code of the current user with enabled two-factor authentication,
+// responds on failure
+func (s *Server) checkCurrentCode(ctx *gin.Context) (store.User, bool) {
+	var body CodeBody
+	if err := ctx.BindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return store.User{}, false
+	}
+
+	user, ok := s.currentUser(ctx)
+	if !ok {
+		return store.User{}, false
+	}
+	if user.TOTPEnabledAt == nil {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":   "two_factor_disabled",
+			"message": "Two-factor authentication isn't enabled",
+		})
+		return store.User{}, false
+	}
+
+	ok, err := s.checkSecondFactor(ctx, user, body.Code)
+	if err != nil {
+		storeError(ctx, err, "Couldn't check the code")
+		return store.User{}, false
+	}
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "wrong_code",
+			"message": "Invalid code",
+		})
+		return store.User{}, false
+	}
+	return user, true
+}
+
+func (s *Server) disableTwoFactor(ctx *gin.Context) {
+	user, ok := s.checkCurrentCode(ctx)
+	if !ok {
+		return
+	}
+
+	required, err := s.twoFactorRequired(ctx, user)
+	if err != nil {
+		storeError(ctx, err, "Couldn't check two-factor policy")
+		return
+	}
+	if required {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":   "two_factor_required",
+			"message": "Two-factor authentication is required for role " + user.Role,
+		})
+		return
+	}
+
+	if err := s.store.SetTOTPSecret(ctx, user.Username, "", time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't disable two-factor authentication")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{Action: AuditTwoFactorDisable, Actor: userActor(user.Username)})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Two-factor authentication has been disabled",
+	})
+}
+
+func (s *Server) regenerateRecoveryCodes(ctx *gin.Context) {
+	user, ok := s.checkCurrentCode(ctx)
+	if !ok {
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		logger.Error(err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Couldn't generate recovery codes",
+		})
+		return
+	}
+	if err := s.store.SetRecoveryCodes(ctx, user.Username, hashes); err != nil {
+		storeError(ctx, err, "Couldn't save recovery codes")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{Action: AuditRecoveryCodesRegenerate, Actor: userActor(user.Username)})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"recovery_codes": codes,
+	})
+}
+
+// resetTwoFactor removes two-factor authentication of a user who lost the device,
+// users of the required roles enroll again on the next login
+func (s *Server) resetTwoFactor(ctx *gin.Context) {
+	username := ctx.Param("username")
+	if err := s.store.SetTOTPSecret(ctx, username, "", time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't reset two-factor authentication")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditTwoFactorReset,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		After:  gin.H{"username": username},
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Two-factor authentication has been reset",
+	})
+}
+
+func (s *Server) getTwoFactorRoles(ctx *gin.Context) {
+	roles, err := s.store.TwoFactorRoles(ctx)
+	if err != nil {
+		storeError(ctx, err, "Couldn't find two-factor policy")
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"roles": roles,
+	})
+}
+
+func (s *Server) setTwoFactorRoles(ctx *gin.Context) {
+	var body TwoFactorRolesBody
+	if err := ctx.BindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+	roles := []string{}
+	for _, role := range body.Roles {
+		if err := validRole(role); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"message": "Role invalid",
+			})
+			return
+		}
+		if !arrs.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	before, err := s.store.TwoFactorRoles(ctx)
+	if err != nil {
+		storeError(ctx, err, "Couldn't find two-factor policy")
+		return
+	}
+	if err := s.store.SetTwoFactorRoles(ctx, roles); err != nil {
+		storeError(ctx, err, "Couldn't save two-factor policy")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditTwoFactorRolesSet,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Before: gin.H{"roles": before},
+		After:  gin.H{"roles": roles},
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"roles": roles,
+	})
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"gocash/pkg/logger"
+	"gocash/pkg/store"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the shortest password accepted for new and changed passwords
+const minPasswordLength = 8
+
+// UserBody creates a user, role is viewer when it's empty.
+// Users with clients see only cashes and ranges of those clients
+type UserBody struct {
+	Username string   `json:"username" binding:"required,max=255"`
+	Password string   `json:"password" binding:"required"`
+	Role     string   `json:"role"`
+	Clients  []string `json:"clients"`
+}
+
+// RoleBody replaces role and clients of a user
+type RoleBody struct {
+	Role    string   `json:"role" binding:"required"`
+	Clients []string `json:"clients"`
+}
+
+// PasswordBody resets password of a user
+type PasswordBody struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// PasswordChangeBody changes password of the logged in user
+type PasswordChangeBody struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+func newUser(user store.User) User {
+	return User{
+		Username:   user.Username,
+		Role:       user.Role,
+		Clients:    user.Clients,
+		CreatedAt:  user.CreatedAt,
+		UpdatedAt:  user.UpdatedAt,
+		DisabledAt: user.DisabledAt,
+		TwoFactor:  user.TOTPEnabledAt != nil,
+	}
+}
+
+// hashPassword checks the password length and returns its bcrypt hash
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (s *Server) createUser(ctx *gin.Context) {
+	// Get request body
+	var body UserBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	if body.Role == "" {
+		body.Role = RoleViewer
+	}
+	if err := validRole(body.Role); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Role invalid",
+		})
+		return
+	}
+	if err := s.checkClients(ctx, body.Clients); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Clients invalid",
+		})
+		return
+	}
+
+	password, err := hashPassword(body.Password)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Password invalid",
+		})
+		return
+	}
+
+	user := store.User{
+		Username:  body.Username,
+		Password:  password,
+		Role:      body.Role,
+		Clients:   body.Clients,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.store.CreateUser(ctx, user); err != nil {
+		storeError(ctx, err, "Couldn't save the user")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditUserCreate,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		After:  newUser(user),
+	})
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"user": newUser(user),
+	})
+}
+
+// /users
+// Pagination: offset, limit with defaults respectively 0, 20
+func (s *Server) listUsers(ctx *gin.Context) {
+	offset, limit := Paginate(ctx)
+
+	result, total, err := s.store.ListUsers(ctx, offset, limit)
+	if err != nil {
+		storeError(ctx, err, "Couldn't search from users")
+		return
+	}
+
+	users := make([]User, 0, len(result))
+	for _, user := range result {
+		users = append(users, newUser(user))
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"users": users,
+		"total": total,
+	})
+}
+
+// checkClients returns error if one of the clients doesn't exist
+func (s *Server) checkClients(ctx *gin.Context, clients []string) error {
+	for _, client := range clients {
+		if _, err := s.store.GetClient(ctx, client); err != nil {
+			return fmt.Errorf("client %s: %w", client, err)
+		}
+	}
+	return nil
+}
+
+// setUserRole replaces role and clients of the user, changes apply to the next token refresh
+func (s *Server) setUserRole(ctx *gin.Context) {
+	// Get request body
+	var body RoleBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+	if err := validRole(body.Role); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Role invalid",
+		})
+		return
+	}
+	if err := s.checkClients(ctx, body.Clients); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Clients invalid",
+		})
+		return
+	}
+
+	username := ctx.Param("username")
+	before, err := s.store.UserByUsername(ctx, username)
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the user")
+		return
+	}
+	if err := s.store.SetUserRole(ctx, username, body.Role, body.Clients, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't save the user")
+		return
+	}
+	user, err := s.store.UserByUsername(ctx, username)
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the user")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditUserRoleSet,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Before: newUser(before),
+		After:  newUser(user),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"user": newUser(user),
+	})
+}
+
+// setUserDisabled returns handler which disables or enables the user,
+// users can't disable themselves
+func (s *Server) setUserDisabled(disabled bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username := ctx.Param("username")
+		if disabled && username == CurrentClaims(ctx).User.Username {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "self_disable",
+				"message": "You can't disable yourself",
+			})
+			return
+		}
+
+		before, err := s.store.UserByUsername(ctx, username)
+		if err != nil {
+			storeError(ctx, err, "Couldn't find the user")
+			return
+		}
+		if err := s.store.SetUserDisabled(ctx, username, disabled, time.Now()); err != nil {
+			storeError(ctx, err, "Couldn't save the user")
+			return
+		}
+		if disabled {
+			if err := s.store.RevokeUserRefreshTokens(ctx, username, time.Now()); err != nil {
+				storeError(ctx, err, "Couldn't revoke tokens of the user")
+				return
+			}
+		}
+		user, err := s.store.UserByUsername(ctx, username)
+		if err != nil {
+			storeError(ctx, err, "Couldn't find the user")
+			return
+		}
+
+		action := AuditUserEnable
+		if disabled {
+			action = AuditUserDisable
+		}
+		s.audit(ctx, AuditEntry{
+			Action: action,
+			Actor:  userActor(CurrentClaims(ctx).User.Username),
+			Before: newUser(before),
+			After:  newUser(user),
+		})
+
+		ctx.JSON(http.StatusOK, gin.H{
+			"user": newUser(user),
+		})
+	}
+}
+
+// deleteUser removes the user, users can't delete themselves
+func (s *Server) deleteUser(ctx *gin.Context) {
+	username := ctx.Param("username")
+	if username == CurrentClaims(ctx).User.Username {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "self_delete",
+			"message": "You can't delete yourself",
+		})
+		return
+	}
+
+	before, err := s.store.UserByUsername(ctx, username)
+	if err != nil {
+		storeError(ctx, err, "Couldn't find the user")
+		return
+	}
+	if err := s.store.DeleteUser(ctx, username); err != nil {
+		storeError(ctx, err, "Couldn't delete the user")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditUserDelete,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		Before: newUser(before),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Successfully deleted",
+	})
+}
+
+// resetUserPassword sets a new password of the user without the current one
+func (s *Server) resetUserPassword(ctx *gin.Context) {
+	// Get request body
+	var body PasswordBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	password, err := hashPassword(body.Password)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Password invalid",
+		})
+		return
+	}
+
+	username := ctx.Param("username")
+	if err := s.store.SetUserPassword(ctx, username, password, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't save the password")
+		return
+	}
+	// Sessions opened with the old password are logged out
+	if err := s.store.RevokeUserRefreshTokens(ctx, username, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't revoke tokens of the user")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditUserPasswordReset,
+		Actor:  userActor(CurrentClaims(ctx).User.Username),
+		After:  gin.H{"username": username},
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Password has been changed",
+	})
+}
+
+// changePassword sets a new password of the logged in user after checking the current one
+func (s *Server) changePassword(ctx *gin.Context) {
+	// Get request body
+	var body PasswordChangeBody
+	if err := ctx.BindJSON(&body); err != nil {
+		logger.Errorf("request body wrong %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Request body invalid",
+		})
+		return
+	}
+
+	username := CurrentClaims(ctx).User.Username
+	user, err := s.store.UserByUsername(ctx, username)
+	if err != nil {
+		storeError(ctx, err, "Couldn't find user")
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.CurrentPassword)); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "wrong_password",
+			"message": "Invalid password",
+		})
+		return
+	}
+
+	password, err := hashPassword(body.NewPassword)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"message": "Password invalid",
+		})
+		return
+	}
+	if err := s.store.SetUserPassword(ctx, username, password, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't save the password")
+		return
+	}
+	// Sessions opened with the old password are logged out
+	if err := s.store.RevokeUserRefreshTokens(ctx, username, time.Now()); err != nil {
+		storeError(ctx, err, "Couldn't revoke tokens of the user")
+		return
+	}
+
+	s.audit(ctx, AuditEntry{
+		Action: AuditUserPasswordChange,
+		Actor:  userActor(username),
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Password has been changed",
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gocash/pkg/config"
+	"gocash/pkg/store"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// runUser handles `gocash user create <username> [role]` and `gocash user disable|reset-password|unlock <username>`,
+// passwords are read from the standard input. Users created by the command are admins by default
+func runUser(cfg config.Config, args []string) {
+	if len(args) < 2 || len(args) > 3 || len(args) == 3 && args[0] != "create" {
+		log.Fatal("usage: gocash user create <username> [role] | gocash user disable|reset-password|unlock <username>")
+	}
+	command, username := args[0], args[1]
+
+	st := openStore(cfg.DatabaseURL)
+	defer st.Close()
+	ctx := context.Background()
+
+	switch command {
+	case "create":
+		role := RoleAdmin
+		if len(args) == 3 {
+			role = args[2]
+		}
+		if err := validRole(role); err != nil {
+			log.Fatalf("couldn't create user: %v", err)
+		}
+		password, err := hashPassword(readPassword())
+		if err != nil {
+			log.Fatalf("couldn't create user: %v", err)
+		}
+		err = st.CreateUser(ctx, store.User{
+			Username:  username,
+			Password:  password,
+			Role:      role,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		})
+		if err != nil {
+			log.Fatalf("couldn't create user: %v", err)
+		}
+		fmt.Printf("created user %s\n", username)
+	case "disable":
+		if err := st.SetUserDisabled(ctx, username, true, time.Now()); err != nil {
+			log.Fatalf("couldn't disable user: %v", err)
+		}
+		if err := st.RevokeUserRefreshTokens(ctx, username, time.Now()); err != nil {
+			log.Fatalf("couldn't revoke tokens of user: %v", err)
+		}
+		fmt.Printf("disabled user %s\n", username)
+	case "reset-password":
+		password, err := hashPassword(readPassword())
+		if err != nil {
+			log.Fatalf("couldn't reset password: %v", err)
+		}
+		if err := st.SetUserPassword(ctx, username, password, time.Now()); err != nil {
+			log.Fatalf("couldn't reset password: %v", err)
+		}
+		if err := st.RevokeUserRefreshTokens(ctx, username, time.Now()); err != nil {
+			log.Fatalf("couldn't revoke tokens of user: %v", err)
+		}
+		fmt.Printf("changed password of user %s\n", username)
+	case "unlock":
+		if err := st.ClearLoginFailures(ctx, userAttemptKey(username)); err != nil {
+			log.Fatalf("couldn't unlock user: %v", err)
+		}
+		fmt.Printf("unlocked user %s\n", username)
+	default:
+		log.Fatalf("unknown user command %q, usage: gocash user create <username> [role] | gocash user disable|reset-password|unlock <username>", command)
+	}
+}
+
+// readPassword reads the password from the terminal without echo or the first line of piped input
+func readPassword() string {
+	fmt.Fprint(os.Stderr, "Password: ")
+
+	// Terminals don't echo the password, piped input is read as a line
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Fatalf("couldn't read password: %v", err)
+		}
+		return string(password)
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("couldn't read password: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}